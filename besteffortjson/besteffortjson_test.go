@@ -7,6 +7,15 @@ import (
 	"testing"
 )
 
+// parse_fragment runs the parser over a bare JSON fragment, without looking
+// for the start of the document first.
+func parse_fragment(input string) interface{} {
+	parser := NewStreamParser()
+	parser.begin_document(0)
+	parser.Write(input)
+	return parser.Value()
+}
+
 func TestParse_string(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -21,12 +30,24 @@ func TestParse_string(t *testing.T) {
 		{name: "String with accented letter", input: `"héllo"`, expected: "héllo"},
 		{name: "String with accented vowel", input: `"hëllò"`, expected: "hëllò"},
 		{name: "String with special character", input: `"hellö"`, expected: "hellö"},
-		{name: "String with unsupported unicode escape sequence", input: `"hell\u00F6"`, expected: "hell\\u00F6"},
+		{name: "String with unicode escape sequence", input: `"hell\u00F6"`, expected: "hellö"},
+		{name: "String with lowercase unicode escape", input: `"caf\u00e9"`, expected: "café"},
+		{name: "String with surrogate pair", input: `"hi \ud83d\ude00!"`, expected: "hi 😀!"},
+		{name: "String with lone high surrogate", input: `"a\ud83d b"`, expected: "a\uFFFD b"},
+		{name: "String with lone low surrogate", input: `"a\ude00b"`, expected: "a\uFFFDb"},
+		{name: "String with control escapes", input: `"a\rb\bc\fd\/e"`, expected: "a\rb\bc\fd/e"},
+		{name: "String with truncated unicode escape", input: `"hell\u00`, expected: "hell"},
+		{name: "String with truncated surrogate pair", input: `"hi \ud83d\ude`, expected: "hi "},
+		{name: "String with invalid unicode escape", input: `"a\u12x4"`, expected: "a\\u12x4"},
+		{name: "Key with unicode escape", input: `{"caf\u00e9": 1}`, expected: "map[café:1]"},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result, _ := parse_string(0, []rune(tc.input))
+			result := parse_fragment(tc.input)
+			if _, is_object := result.(map[string]interface{}); is_object {
+				result = fmt.Sprint(result)
+			}
 			if result != tc.expected {
 				t.Errorf("Expected %s, got %s", tc.expected, result)
 			}
@@ -54,7 +75,7 @@ func TestParse_number_or_boolean_or_null(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result, _ := parse_number_or_boolean_or_null(0, []rune(tc.input))
+			result := parse_fragment(tc.input)
 			if result != tc.expected {
 				resultType := reflect.TypeOf(result)
 				expectedType := reflect.TypeOf(tc.expected)
@@ -100,7 +121,7 @@ func TestParse_array(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result, _ := parse_array(0, []rune(tc.input))
+			result := parse_fragment(tc.input)
 			if !reflect.DeepEqual(result, tc.expected) {
 				expectedJson, _ := json.Marshal(tc.expected)
 				resultJson, _ := json.Marshal(result)
@@ -270,3 +291,69 @@ func TestBest_effort_json_parse(t *testing.T) {
 		})
 	}
 }
+
+func TestBest_effort_json_parse_lenient(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			"line comments",
+			"{\n\t\"results\": [\n\t\t{\"a\": 1}, // first\n\t\t{\"a\": 2},\n\t\t// etc.\n\t]\n}",
+			`{"results":[{"a":1},{"a":2}]}`,
+		},
+		{
+			"block comments",
+			`{"a": /* the answer */ 42, /* "b": 1, */ "c": [1 /* one */, 2]}`,
+			`{"a":42,"c":[1,2]}`,
+		},
+		{
+			"comment right after a number",
+			"{\"a\": 1// one\n}",
+			`{"a":1}`,
+		},
+		{
+			"slashes inside strings are not comments",
+			`{"url": "https://example.com/*path*/"}`,
+			`{"url":"https://example.com/*path*/"}`,
+		},
+		{
+			"single quotes",
+			`{'name': 'Ada \'the countess\' Lovelace', "mixed": 'it"s'}`,
+			`{"name":"Ada 'the countess' Lovelace","mixed":"it\"s"}`,
+		},
+		{
+			"unquoted keys",
+			`{name: "Ada", year_of_birth : 1815, $ref: null, nested: {inner_key: true}}`,
+			`{"name":"Ada","year_of_birth":1815,"$ref":null,"nested":{"inner_key":true}}`,
+		},
+		{
+			"python and javascript literals",
+			`{"a": True, "b": False, "c": None, "d": NaN, "e": Infinity, "f": -Infinity, "g": undefined, "h": TRUE}`,
+			`{"a":true,"b":false,"c":null,"d":null,"e":null,"f":null,"g":null,"h":true}`,
+		},
+		{
+			"trailing commas in objects and arrays",
+			`{"a": [1, 2,], "b": {"c": 3,},}`,
+			`{"a":[1,2],"b":{"c":3}}`,
+		},
+		{
+			"unfinished unquoted key is ignored",
+			`{name: "Ada", ye`,
+			`{"name":"Ada"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := Best_effort_json_parse_with_options(tc.input, Lenient)
+			if result != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, result)
+			}
+			if !json.Valid([]byte(result)) {
+				t.Errorf("Result is not valid JSON: %s", result)
+			}
+		})
+	}
+}
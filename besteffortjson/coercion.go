@@ -0,0 +1,116 @@
+package besteffortjson
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Coercion converts values the model wrote in a different but unambiguous
+// form into the Go type they are decoded into.
+type Coercion struct {
+	// Numeric_strings decodes "1905" and " 4.5 " into ints, uints and floats.
+	Numeric_strings bool
+	// Numbers_to_strings decodes 1905 into a string as "1905".
+	Numbers_to_strings bool
+	// Boolean_strings decodes "yes", "no", "true", "false", "y", "n", "on",
+	// "off", "1" and "0" in any case, and the numbers 1 and 0, into bools.
+	Boolean_strings bool
+	// Single_values decodes a lone value into a one element slice.
+	Single_values bool
+	// Dates decodes strings in common date formats into time.Time. Layouts
+	// are tried first, then RFC 3339 and the formats in Date_layouts.
+	Dates   bool
+	Layouts []string
+}
+
+// Default_coercion enables every coercion.
+var Default_coercion = Coercion{
+	Numeric_strings:    true,
+	Numbers_to_strings: true,
+	Boolean_strings:    true,
+	Single_values:      true,
+	Dates:              true,
+}
+
+// Date_layouts are the formats Coercion.Dates accepts besides RFC 3339.
+var Date_layouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+	"January 2, 2006",
+	"January 2 2006",
+	"Jan 2, 2006",
+	"Jan 2 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+	"January 2006",
+	"Jan 2006",
+	"01/02/2006",
+	"2006/01/02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+}
+
+var time_type = reflect.TypeOf(time.Time{})
+
+// numeric_string turns a string node holding a number into a number node.
+func (c Coercion) numeric_string(n *node) *node {
+	if !c.Numeric_strings || n.kind != kind_string {
+		return n
+	}
+
+	text := strings.TrimSpace(n.text.String())
+	if _, err := strconv.ParseFloat(text, 64); err != nil {
+		return n
+	}
+	number := &node{kind: kind_number, complete: n.complete}
+	number.text.WriteString(text)
+	return number
+}
+
+func (c Coercion) boolean(n *node) (value bool, ok bool) {
+	if !c.Boolean_strings {
+		return false, false
+	}
+
+	switch n.kind {
+	case kind_string:
+		switch strings.ToLower(strings.TrimSpace(n.text.String())) {
+		case "yes", "y", "true", "on", "1":
+			return true, true
+		case "no", "n", "false", "off", "0":
+			return false, true
+		}
+	case kind_number:
+		switch n.text.String() {
+		case "1":
+			return true, true
+		case "0":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+func (c Coercion) date(n *node) (time.Time, bool) {
+	if !c.Dates || n.kind != kind_string {
+		return time.Time{}, false
+	}
+
+	text := strings.TrimSpace(n.text.String())
+	layouts := append(append(append([]string(nil), c.Layouts...), time.RFC3339Nano), Date_layouts...)
+	for _, layout := range layouts {
+		if date, err := time.Parse(layout, text); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,79 @@
+package besteffortjson
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecoder_coercion(t *testing.T) {
+	type Event struct {
+		Year      int       `json:"year"`
+		Score     float64   `json:"score"`
+		Count     uint      `json:"count"`
+		Label     string    `json:"label"`
+		Confirmed bool      `json:"confirmed"`
+		Rejected  bool      `json:"rejected"`
+		Tags      []string  `json:"tags"`
+		Years     []int     `json:"years"`
+		Date      time.Time `json:"date"`
+		Published time.Time `json:"published"`
+	}
+
+	input := `{"year": "1905", "score": " 4.5 ", "count": "12", "label": 42, "confirmed": "Yes",
+		"rejected": 0, "tags": "physics", "years": "1905", "date": "June 30, 1905", "published": "1905-09-26"}`
+
+	t.Run("Default coercion", func(t *testing.T) {
+		result, diagnostics := Parse[Event](input)
+		expected := Event{
+			Year:      1905,
+			Score:     4.5,
+			Count:     12,
+			Label:     "42",
+			Confirmed: true,
+			Rejected:  false,
+			Tags:      []string{"physics"},
+			Years:     []int{1905},
+			Date:      time.Date(1905, 6, 30, 0, 0, 0, 0, time.UTC),
+			Published: time.Date(1905, 9, 26, 0, 0, 0, 0, time.UTC),
+		}
+		if len(diagnostics) > 0 {
+			t.Errorf("Unexpected diagnostics %v", diagnostics)
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, result)
+		}
+	})
+
+	t.Run("Coercion off", func(t *testing.T) {
+		var result Event
+		diagnostics := Decoder{Options: Lenient}.Decode(input, &result)
+
+		var paths []string
+		for _, diagnostic := range diagnostics {
+			paths = append(paths, diagnostic.Path)
+		}
+		expected := []string{"/year", "/score", "/count", "/label", "/confirmed", "/rejected", "/tags", "/years", "/date", "/published"}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("Expected diagnostics at %v, got %v", expected, diagnostics)
+		}
+	})
+
+	t.Run("Custom date layouts and failures", func(t *testing.T) {
+		var result struct {
+			Date  time.Time `json:"date"`
+			Other time.Time `json:"other"`
+			Flag  bool      `json:"flag"`
+			Year  int       `json:"year"`
+		}
+		decoder := Decoder{Coercion: Coercion{Dates: true, Boolean_strings: true, Numeric_strings: true, Layouts: []string{"02.01.2006"}}}
+		diagnostics := decoder.Decode(`{"date": "30.06.1905", "other": "sometime", "flag": "maybe", "year": "around 1905"}`, &result)
+
+		if !result.Date.Equal(time.Date(1905, 6, 30, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Expected the custom layout to be used, got %v", result.Date)
+		}
+		if len(diagnostics) != 3 {
+			t.Errorf("Expected 3 diagnostics, got %v", diagnostics)
+		}
+	})
+}
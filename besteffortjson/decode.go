@@ -0,0 +1,531 @@
+package besteffortjson
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrNoJson is the error of the Diagnostic returned when there is no JSON to
+// decode at all.
+var ErrNoJson = errors.New("besteffortjson: no JSON found")
+
+// ErrNoValue is the error of the Diagnostic returned by Decode_pointer when
+// the document has no value at the pointer.
+var ErrNoValue = errors.New("besteffortjson: no value at this pointer")
+
+// Diagnostic is a value that couldn't be decoded and was left as it was.
+type Diagnostic struct {
+	// Path is the JSON Pointer of the value in the document, "" for the
+	// document itself.
+	Path string
+	Err  error
+}
+
+func (d Diagnostic) Error() string {
+	if d.Path == "" {
+		return d.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", d.Path, d.Err)
+}
+
+func (d Diagnostic) Unwrap() error {
+	return d.Err
+}
+
+// Diagnostics lists every value that was skipped while decoding, in document
+// order.
+type Diagnostics []Diagnostic
+
+// TypeError is the error of a Diagnostic for a JSON value that doesn't fit
+// the Go type it was decoded into.
+type TypeError struct {
+	// Value describes the JSON value, like "string" or "number 1.5".
+	Value string
+	Type  reflect.Type
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("cannot decode %s into %s", e.Value, e.Type)
+}
+
+// Decoder decodes best-effort JSON straight into Go values, field by field.
+// Values that don't fit, even after Coercion, are skipped and reported,
+// everything else is kept. Fields are matched to keys the way encoding/json
+// matches them.
+type Decoder struct {
+	// Options is the dialect Decode parses with.
+	Options  Options
+	Coercion Coercion
+	// Key_naming names fields without a json tag name. nil keeps the Go
+	// name, like encoding/json.
+	Key_naming Key_naming
+}
+
+// Parse decodes the most plausible JSON document in raw into a T, using the
+// Lenient dialect and Default_coercion.
+func Parse[T any](raw string) (T, Diagnostics) {
+	var result T
+	diagnostics := Decoder{Options: Lenient, Coercion: Default_coercion}.Decode(raw, &result)
+	return result, diagnostics
+}
+
+// Decode parses raw and decodes its most plausible JSON document into
+// target, which must be a non-nil pointer.
+func (d Decoder) Decode(raw string, target interface{}) Diagnostics {
+	parser := NewStreamParser()
+	parser.Options = d.Options
+	parser.Write(raw)
+
+	document, _ := parser.Document()
+	return d.Decode_document(document, target)
+}
+
+// Decode_document decodes a document found by a StreamParser into target,
+// which must be a non-nil pointer.
+func (d Decoder) Decode_document(document Document, target interface{}) Diagnostics {
+	return d.Decode_pointer(document, "", target)
+}
+
+// Decode_pointer decodes the value at a JSON Pointer of a document into
+// target, so a stream can decode the part of it that changed without the
+// rest. Diagnostic paths are still relative to the document.
+func (d Decoder) Decode_pointer(document Document, pointer string, target interface{}) Diagnostics {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return Diagnostics{{Err: fmt.Errorf("besteffortjson: cannot decode into %T, it needs a non-nil pointer", target)}}
+	}
+	if document.root == nil {
+		return Diagnostics{{Err: ErrNoJson}}
+	}
+	n := document.root.lookup(pointer)
+	if n == nil {
+		return Diagnostics{{Path: pointer, Err: ErrNoValue}}
+	}
+
+	state := decode_state{coercion: d.Coercion, naming: d.Key_naming}
+	state.decode(n, pointer, v.Elem())
+	return state.diagnostics
+}
+
+// Incremental_decoder decodes a document that is still being streamed into
+// the same target after every write. Objects and arrays remember how many of
+// their leading values were complete when they were last decoded, and only
+// the values after those are decoded again, so a call costs as much as the
+// part of the document still open rather than the whole of it.
+//
+// Values inside the target, like the elements of its slices, are filled in
+// again in place by later calls.
+type Incremental_decoder struct {
+	Decoder
+
+	root     *node
+	target   interface{}
+	progress map[*node]decode_progress
+}
+
+// decode_progress is how many leading keys or items of an object or array
+// were complete when it was last decoded, and its replaced count then.
+type decode_progress struct {
+	done     int
+	replaced int
+}
+
+// Decode_document decodes document into target, which must be the same
+// non-nil pointer on every call. Another document or target starts over from
+// a zero target.
+func (d *Incremental_decoder) Decode_document(document Document, target interface{}) Diagnostics {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return Diagnostics{{Err: fmt.Errorf("besteffortjson: cannot decode into %T, it needs a non-nil pointer", target)}}
+	}
+	if document.root == nil {
+		return Diagnostics{{Err: ErrNoJson}}
+	}
+	if document.root != d.root || target != d.target {
+		d.root, d.target, d.progress = document.root, target, map[*node]decode_progress{}
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	}
+
+	state := decode_state{coercion: d.Coercion, naming: d.Key_naming, progress: d.progress}
+	state.decode(document.root, "", v.Elem())
+	return state.diagnostics
+}
+
+type decode_state struct {
+	coercion    Coercion
+	naming      Key_naming
+	diagnostics Diagnostics
+	// progress is set by Incremental_decoder.
+	progress map[*node]decode_progress
+}
+
+// resume returns how many leading keys or items of n are already decoded in
+// v, which is none unless the decoding is incremental. An object with a key
+// set again since then starts over from a zero v, which may still hold the
+// earlier value of the key, and so does everything below it.
+func (s *decode_state) resume(n *node, v reflect.Value) int {
+	progress, ok := s.progress[n]
+	if !ok {
+		return 0
+	}
+	if progress.replaced != n.replaced {
+		v.Set(reflect.Zero(v.Type()))
+		clear(s.progress)
+		return 0
+	}
+	return progress.done
+}
+
+// advance records the leading keys or items of n that are complete after
+// decoding it from start, so the next incremental decoding skips them.
+func (s *decode_state) advance(n *node, start int) {
+	if s.progress == nil {
+		return
+	}
+	done := start
+	if n.kind == kind_object {
+		// A key whose value hasn't started yet has no field.
+		for done < len(n.keys) && n.fields[n.keys[done]] != nil && n.fields[n.keys[done]].complete {
+			done++
+		}
+	} else {
+		for done < len(n.items) && n.items[done].complete {
+			done++
+		}
+	}
+	s.progress[n] = decode_progress{done: done, replaced: n.replaced}
+}
+
+func (s *decode_state) report(path string, err error) bool {
+	s.diagnostics = append(s.diagnostics, Diagnostic{Path: path, Err: err})
+	return false
+}
+
+func (s *decode_state) mismatch(n *node, path string, v reflect.Value) bool {
+	return s.report(path, &TypeError{Value: n.describe(), Type: v.Type()})
+}
+
+var (
+	json_unmarshaler_type = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	text_unmarshaler_type = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// decode stores n in v and reports whether it could. Nothing is stored when
+// it couldn't.
+func (s *decode_state) decode(n *node, path string, v reflect.Value) bool {
+	if n.is_null() {
+		switch v.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return true
+	}
+
+	if v.Kind() == reflect.Pointer {
+		if !v.IsNil() {
+			return s.decode(n, path, v.Elem())
+		}
+		target := reflect.New(v.Type().Elem())
+		if !s.decode(n, path, target.Elem()) {
+			return false
+		}
+		v.Set(target)
+		return true
+	}
+
+	if v.Type() == time_type {
+		if date, ok := s.coercion.date(n); ok {
+			v.Set(reflect.ValueOf(date))
+			return true
+		}
+	}
+
+	if v.CanAddr() {
+		pointer := v.Addr()
+		switch {
+		case pointer.Type().Implements(json_unmarshaler_type):
+			var buffer bytes.Buffer
+			n.encode(&buffer)
+			if err := pointer.Interface().(json.Unmarshaler).UnmarshalJSON(buffer.Bytes()); err != nil {
+				return s.report(path, err)
+			}
+			return true
+		case pointer.Type().Implements(text_unmarshaler_type) && n.kind == kind_string:
+			if err := pointer.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(n.text.String())); err != nil {
+				return s.report(path, err)
+			}
+			return true
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return s.mismatch(n, path, v)
+		}
+		v.Set(reflect.ValueOf(n.value()))
+	case reflect.Struct:
+		return s.decode_struct(n, path, v)
+	case reflect.Map:
+		return s.decode_map(n, path, v)
+	case reflect.Slice:
+		return s.decode_slice(n, path, v)
+	case reflect.Array:
+		if n.kind != kind_array {
+			return s.mismatch(n, path, v)
+		}
+		for i := 0; i < v.Len(); i++ {
+			if s.progress == nil {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+			}
+			if i < len(n.items) {
+				s.decode(n.items[i], path+"/"+strconv.Itoa(i), v.Index(i))
+			}
+		}
+	case reflect.String:
+		switch {
+		case n.kind == kind_string:
+			v.SetString(n.text.String())
+		case n.kind == kind_number && s.coercion.Numbers_to_strings:
+			v.SetString(n.text.String())
+		default:
+			return s.mismatch(n, path, v)
+		}
+	case reflect.Bool:
+		value, ok := n.value().(bool)
+		if n.kind != kind_literal {
+			value, ok = s.coercion.boolean(n)
+		}
+		if !ok {
+			return s.mismatch(n, path, v)
+		}
+		v.SetBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value, ok := s.coercion.numeric_string(n).int_value()
+		if !ok || v.OverflowInt(value) {
+			return s.mismatch(n, path, v)
+		}
+		v.SetInt(value)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		value, ok := s.coercion.numeric_string(n).uint_value()
+		if !ok || v.OverflowUint(value) {
+			return s.mismatch(n, path, v)
+		}
+		v.SetUint(value)
+	case reflect.Float32, reflect.Float64:
+		value, ok := s.coercion.numeric_string(n).float_value()
+		if !ok || v.OverflowFloat(value) {
+			return s.mismatch(n, path, v)
+		}
+		v.SetFloat(value)
+	default:
+		return s.mismatch(n, path, v)
+	}
+
+	return true
+}
+
+func (s *decode_state) decode_struct(n *node, path string, v reflect.Value) bool {
+	if n.kind != kind_object {
+		return s.mismatch(n, path, v)
+	}
+
+	fields := cached_fields(v.Type(), s.naming)
+	start := s.resume(n, v)
+	defer s.advance(n, start)
+	for _, key := range n.keys[start:] {
+		field, ok := find_field(fields, key)
+		if !ok {
+			continue
+		}
+
+		value := n.fields[key]
+		if field.Quoted {
+			value = unquote(value)
+		}
+		s.decode(value, path+"/"+escape_pointer_token(key), field_by_index(v, field.Index))
+	}
+	return true
+}
+
+func (s *decode_state) decode_map(n *node, path string, v reflect.Value) bool {
+	if n.kind != kind_object {
+		return s.mismatch(n, path, v)
+	}
+
+	key_type := v.Type().Key()
+	start := s.resume(n, v)
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(v.Type(), len(n.keys)))
+		start = 0
+	}
+	defer s.advance(n, start)
+	for _, key := range n.keys[start:] {
+		item_path := path + "/" + escape_pointer_token(key)
+
+		map_key := reflect.New(key_type).Elem()
+		switch key_type.Kind() {
+		case reflect.String:
+			map_key.SetString(key)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			number, err := strconv.ParseInt(key, 10, 64)
+			if err != nil || map_key.OverflowInt(number) {
+				s.report(item_path, &TypeError{Value: "key " + strconv.Quote(key), Type: key_type})
+				continue
+			}
+			map_key.SetInt(number)
+		default:
+			return s.report(path, &TypeError{Value: "object", Type: v.Type()})
+		}
+
+		// Incremental decoding carries on from the value decoded last time.
+		item := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(map_key); s.progress != nil && existing.IsValid() {
+			item.Set(existing)
+		}
+		if s.decode(n.fields[key], item_path, item) {
+			v.SetMapIndex(map_key, item)
+		}
+	}
+	return true
+}
+
+// decode_slice keeps items that couldn't be decoded as zero values, so
+// indices match the document.
+func (s *decode_state) decode_slice(n *node, path string, v reflect.Value) bool {
+	if n.kind == kind_string && v.Type().Elem().Kind() == reflect.Uint8 {
+		decoded, err := base64.StdEncoding.DecodeString(n.text.String())
+		if err != nil {
+			return s.report(path, err)
+		}
+		v.SetBytes(decoded)
+		return true
+	}
+	if n.kind != kind_array && s.coercion.Single_values {
+		result := reflect.MakeSlice(v.Type(), 1, 1)
+		if s.progress != nil && v.Len() == 1 {
+			reflect.Copy(result, v)
+		}
+		if !s.decode(n, path, result.Index(0)) {
+			return false
+		}
+		v.Set(result)
+		return true
+	}
+	if n.kind != kind_array {
+		return s.mismatch(n, path, v)
+	}
+
+	// Incremental decoding keeps the items already decoded and grows the
+	// slice the way append does.
+	start := s.resume(n, v)
+	var result reflect.Value
+	switch {
+	case s.progress == nil || start > v.Len() || v.IsNil():
+		start = 0
+		result = reflect.MakeSlice(v.Type(), len(n.items), len(n.items))
+	case len(n.items) <= v.Cap():
+		result = v.Slice(0, len(n.items))
+	default:
+		result = reflect.MakeSlice(v.Type(), len(n.items), max(len(n.items), 2*v.Cap()))
+		reflect.Copy(result, v)
+	}
+	for i := start; i < len(n.items); i++ {
+		s.decode(n.items[i], path+"/"+strconv.Itoa(i), result.Index(i))
+	}
+	v.Set(result)
+	s.advance(n, start)
+	return true
+}
+
+// unquote reads the string of a field with the ",string" tag option as the
+// number or bool inside it.
+func unquote(n *node) *node {
+	if n == nil || n.kind != kind_string {
+		return n
+	}
+
+	text := strings.TrimSpace(n.text.String())
+	if text == "true" || text == "false" || text == "null" {
+		literal := &node{kind: kind_literal, complete: n.complete}
+		literal.text.WriteString(text)
+		return literal
+	}
+	return Coercion{Numeric_strings: true}.numeric_string(n)
+}
+
+func (n *node) is_null() bool {
+	return n == nil || (n.kind == kind_literal && n.value() == nil)
+}
+
+// describe names the JSON type of n for a TypeError.
+func (n *node) describe() string {
+	switch n.kind {
+	case kind_object:
+		return "object"
+	case kind_array:
+		return "array"
+	case kind_string:
+		return "string"
+	case kind_number:
+		return "number " + n.text.String()
+	default:
+		return "bool"
+	}
+}
+
+func (n *node) int_value() (int64, bool) {
+	if n.kind != kind_number {
+		return 0, false
+	}
+	if value, err := strconv.ParseInt(n.text.String(), 10, 64); err == nil {
+		return value, true
+	}
+
+	switch value := n.value().(type) {
+	case int:
+		return int64(value), true
+	case float64:
+		if value == math.Trunc(value) && value >= math.MinInt64 && value < math.MaxInt64 {
+			return int64(value), true
+		}
+	}
+	return 0, false
+}
+
+func (n *node) uint_value() (uint64, bool) {
+	if n.kind != kind_number {
+		return 0, false
+	}
+	if value, err := strconv.ParseUint(n.text.String(), 10, 64); err == nil {
+		return value, true
+	}
+
+	value, ok := n.int_value()
+	if !ok || value < 0 {
+		return 0, false
+	}
+	return uint64(value), true
+}
+
+func (n *node) float_value() (float64, bool) {
+	if n.kind != kind_number {
+		return 0, false
+	}
+
+	switch value := n.value().(type) {
+	case int:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
@@ -0,0 +1,190 @@
+package besteffortjson
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	type Author struct {
+		Name string `json:"name"`
+		Born *int   `json:"born"`
+	}
+	type Timestamps struct {
+		Created time.Time `json:"created"`
+	}
+	type Book struct {
+		Timestamps
+		Title         string         `json:"title"`
+		YearPublished string         `json:"year_published"`
+		Rating        float32        `json:"rating"`
+		Pages         uint16         `json:"pages"`
+		Tags          []string       `json:"tags"`
+		Authors       []Author       `json:"authors"`
+		Counts        map[string]int `json:"counts"`
+		Extra         interface{}    `json:"extra"`
+		Ignored       string         `json:"-"`
+		Available     bool
+		Editions      map[int]string    `json:"editions"`
+		Notes         map[string]string `json:"notes"`
+	}
+
+	born := 1815
+	testCases := []struct {
+		name     string
+		input    string
+		expected Book
+		paths    []string
+	}{
+		{
+			name:     "Object where a string is expected only drops that field",
+			input:    `{"title": "Dune", "year_published": {"year": 1965}, "rating": 4.5}`,
+			expected: Book{Title: "Dune", Rating: 4.5},
+			paths:    []string{"/year_published"},
+		},
+		{
+			name: "Nested values, pointers and maps",
+			input: `Here you go: {"authors": [{"name": "Ada", "born": 1815}, "Grace", {"name": {"first": "Grace"}}],
+				"counts": {"a": 1, "b": "two"}, "extra": [1, "x"], "Ignored": "no", "AVAILABLE": true,
+				"editions": {"1": "first", "x": "bad"}, "notes": null, "created": "2024-05-01T00:00:00Z"}`,
+			expected: Book{
+				Timestamps: Timestamps{Created: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+				Authors:    []Author{{Name: "Ada", Born: &born}, {}, {}},
+				Counts:     map[string]int{"a": 1},
+				Extra:      []interface{}{1, "x"},
+				Available:  true,
+				Editions:   map[int]string{1: "first"},
+			},
+			paths: []string{"/authors/1", "/authors/2/name", "/counts/b", "/editions/x"},
+		},
+		{
+			name:     "Numbers out of range or with fractions",
+			input:    `{"pages": 70000, "rating": 1e100, "tags": ["a", true, null]}`,
+			expected: Book{Tags: []string{"a", "", ""}},
+			paths:    []string{"/pages", "/rating", "/tags/1"},
+		},
+		{
+			name:     "Unfinished document keeps what has arrived",
+			input:    `{"title": "Dune", "tags": ["sci-fi", "clas`,
+			expected: Book{Title: "Dune", Tags: []string{"sci-fi", "clas"}},
+		},
+		{
+			name:     "Shape mismatch at the top",
+			input:    `["Dune"]`,
+			expected: Book{},
+			paths:    []string{""},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, diagnostics := Parse[Book](tc.input)
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+
+			var paths []string
+			for _, diagnostic := range diagnostics {
+				paths = append(paths, diagnostic.Path)
+			}
+			if !reflect.DeepEqual(paths, tc.paths) {
+				t.Errorf("Expected diagnostics at %q, got %v", tc.paths, diagnostics)
+			}
+		})
+	}
+}
+
+func TestParse_diagnostics(t *testing.T) {
+	_, diagnostics := Parse[struct{ Count int }](`{"count": "many"}`)
+	var type_error *TypeError
+	if len(diagnostics) != 1 || !errors.As(diagnostics[0], &type_error) || type_error.Value != "string" {
+		t.Fatalf("Expected a TypeError for the string, got %v", diagnostics)
+	}
+	if message := diagnostics[0].Error(); message != "/count: cannot decode string into int" {
+		t.Errorf("Unexpected message %q", message)
+	}
+
+	_, diagnostics = Parse[[]int]("No JSON here")
+	if len(diagnostics) != 1 || !errors.Is(diagnostics[0], ErrNoJson) {
+		t.Errorf("Expected ErrNoJson, got %v", diagnostics)
+	}
+
+	if diagnostics := (Decoder{}).Decode(`{}`, struct{}{}); len(diagnostics) != 1 {
+		t.Errorf("Expected a diagnostic for a non-pointer target, got %v", diagnostics)
+	}
+}
+
+func TestDecoder_Decode_pointer(t *testing.T) {
+	parser := NewStreamParser()
+	parser.Write(`{"results": [{"count": 1}, {"count": "many"}, {"count": 3`)
+	document, _ := parser.Document()
+
+	var item struct{ Count int }
+	diagnostics := (Decoder{}).Decode_pointer(document, "/results/2", &item)
+	if len(diagnostics) > 0 || item.Count != 3 {
+		t.Errorf("Expected the open item, got %+v %v", item, diagnostics)
+	}
+
+	diagnostics = (Decoder{}).Decode_pointer(document, "/results/1", &item)
+	if len(diagnostics) != 1 || diagnostics[0].Path != "/results/1/count" {
+		t.Errorf("Expected a diagnostic with the path in the document, got %v", diagnostics)
+	}
+
+	diagnostics = (Decoder{}).Decode_pointer(document, "/results/3", &item)
+	if len(diagnostics) != 1 || !errors.Is(diagnostics[0], ErrNoValue) {
+		t.Errorf("Expected ErrNoValue, got %v", diagnostics)
+	}
+}
+
+func TestIncremental_decoder(t *testing.T) {
+	type Section struct {
+		Heading string   `json:"heading"`
+		Lines   []string `json:"lines"`
+	}
+	type Report struct {
+		Title    string             `json:"title"`
+		Sections []Section          `json:"sections"`
+		Index    map[string]Section `json:"index"`
+		Pair     [2]Section         `json:"pair"`
+		Tags     []Section          `json:"tags"`
+	}
+	response := `{"title": "Bees", "sections": [{"heading": "Flight", "lines": ["fast", "far"]}, {"heading": "Honey"}],
+		"index": {"a": {"heading": "A", "lines": ["x"]}, "b": {"heading": "B"}},
+		"pair": [{"heading": "one", "lines": ["1"]}, {"heading": "two"}], "tags": {"heading": "single", "lines": ["y"]},
+		"title": "Wasps"}`
+
+	decoder := Decoder{Options: Lenient, Coercion: Default_coercion}
+	incremental := Incremental_decoder{Decoder: decoder}
+	parser := NewStreamParser()
+	parser.Options = Lenient
+	var report Report
+	for i := range response {
+		parser.Write(response[i : i+1])
+		document, found := parser.Document()
+		if !found {
+			continue
+		}
+		incremental.Decode_document(document, &report)
+
+		var expected Report
+		decoder.Decode_document(document, &expected)
+		if !reflect.DeepEqual(report, expected) {
+			t.Fatalf("After %q expected %+v, got %+v", response[:i+1], expected, report)
+		}
+	}
+	if report.Title != "Wasps" {
+		t.Errorf("Expected the duplicate key to replace the title, got %q", report.Title)
+	}
+
+	// Another target starts over.
+	var other Report
+	parser = NewStreamParser()
+	parser.Write(`{"title": "Ants"}`)
+	document, _ := parser.Document()
+	incremental.Decode_document(document, &other)
+	if !reflect.DeepEqual(other, Report{Title: "Ants"}) {
+		t.Errorf("Expected only the new document, got %+v", other)
+	}
+}
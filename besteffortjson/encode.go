@@ -0,0 +1,264 @@
+package besteffortjson
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+var (
+	json_marshaler_type = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	text_marshaler_type = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Marshal encodes value as JSON like encoding/json does, except that fields
+// without a json tag name are named with naming, the way a Decoder with the
+// same Key_naming reads them back. A nil naming means Verbatim.
+func Marshal(value interface{}, naming Key_naming) ([]byte, error) {
+	var buffer bytes.Buffer
+	state := encode_state{buffer: &buffer, naming: naming}
+	if err := state.encode(reflect.ValueOf(value)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+type encode_state struct {
+	buffer *bytes.Buffer
+	naming Key_naming
+}
+
+func (s *encode_state) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		s.buffer.WriteString("null")
+		return nil
+	}
+
+	if marshaler, ok := as_interface(v, json_marshaler_type); ok {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			s.buffer.WriteString("null")
+			return nil
+		}
+		encoded, err := marshaler.(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return json.Compact(s.buffer, encoded)
+	}
+	if marshaler, ok := as_interface(v, text_marshaler_type); ok {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			s.buffer.WriteString("null")
+			return nil
+		}
+		text, err := marshaler.(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		return s.scalar(string(text))
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			s.buffer.WriteString("null")
+			return nil
+		}
+		return s.encode(v.Elem())
+	case reflect.Struct:
+		return s.encode_struct(v)
+	case reflect.Map:
+		return s.encode_map(v)
+	case reflect.Slice:
+		if v.IsNil() {
+			s.buffer.WriteString("null")
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return s.scalar(base64.StdEncoding.EncodeToString(v.Bytes()))
+		}
+		return s.encode_array(v)
+	case reflect.Array:
+		return s.encode_array(v)
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return s.scalar(v.Interface())
+	}
+	return fmt.Errorf("besteffortjson: cannot encode %s", v.Type())
+}
+
+// as_interface returns v, or a pointer to a copy of it, as an iface if
+// either implements it.
+func as_interface(v reflect.Value, iface reflect.Type) (interface{}, bool) {
+	if v.Type().Implements(iface) {
+		if v.Kind() == reflect.Interface {
+			return nil, false
+		}
+		return v.Interface(), true
+	}
+	if v.Kind() != reflect.Pointer && reflect.PointerTo(v.Type()).Implements(iface) {
+		pointer := reflect.New(v.Type())
+		pointer.Elem().Set(v)
+		return pointer.Interface(), true
+	}
+	return nil, false
+}
+
+func (s *encode_state) scalar(value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.buffer.Write(encoded)
+	return nil
+}
+
+func (s *encode_state) encode_struct(v reflect.Value) error {
+	s.buffer.WriteByte('{')
+	first := true
+	for _, field := range cached_fields(v.Type(), s.naming) {
+		value, ok := field_value(v, field.Index)
+		if !ok || (field.Omitempty && is_empty(value)) {
+			continue
+		}
+
+		if !first {
+			s.buffer.WriteByte(',')
+		}
+		first = false
+		s.scalar(field.Name)
+		s.buffer.WriteByte(':')
+
+		if field.Quoted && is_quotable(value) {
+			var quoted bytes.Buffer
+			if err := (&encode_state{buffer: &quoted, naming: s.naming}).encode(value); err != nil {
+				return err
+			}
+			s.scalar(quoted.String())
+			continue
+		}
+		if err := s.encode(value); err != nil {
+			return err
+		}
+	}
+	s.buffer.WriteByte('}')
+	return nil
+}
+
+// field_value follows index through embedded structs, reporting false when
+// it goes through a nil pointer.
+func field_value(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, field := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(field)
+	}
+	return v, true
+}
+
+// is_quotable is set for the values the ",string" tag option applies to.
+func is_quotable(v reflect.Value) bool {
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func (s *encode_state) encode_map(v reflect.Value) error {
+	if v.IsNil() {
+		s.buffer.WriteString("null")
+		return nil
+	}
+
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	var entries []entry
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := map_key(iter.Key())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{key: key, value: iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	s.buffer.WriteByte('{')
+	for i, entry := range entries {
+		if i > 0 {
+			s.buffer.WriteByte(',')
+		}
+		s.scalar(entry.key)
+		s.buffer.WriteByte(':')
+		if err := s.encode(entry.value); err != nil {
+			return err
+		}
+	}
+	s.buffer.WriteByte('}')
+	return nil
+}
+
+func map_key(key reflect.Value) (string, error) {
+	if key.Kind() == reflect.String {
+		return key.String(), nil
+	}
+	if marshaler, ok := as_interface(key, text_marshaler_type); ok {
+		text, err := marshaler.(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("besteffortjson: cannot encode map key %s", key.Type())
+}
+
+func (s *encode_state) encode_array(v reflect.Value) error {
+	s.buffer.WriteByte('[')
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			s.buffer.WriteByte(',')
+		}
+		if err := s.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	s.buffer.WriteByte(']')
+	return nil
+}
+
+// is_empty is the omitempty test of encoding/json.
+func is_empty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package besteffortjson
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type encode_level int
+
+func (l encode_level) MarshalText() ([]byte, error) {
+	return []byte([]string{"low", "high"}[l]), nil
+}
+
+func (l *encode_level) UnmarshalText(text []byte) error {
+	*l = 0
+	if string(text) == "high" {
+		*l = 1
+	}
+	return nil
+}
+
+type Encode_base struct {
+	CreatedBy string
+}
+
+type encode_paper struct {
+	*Encode_base
+	YearPublished int               `json:",string"`
+	Title         string            `json:"title"`
+	Summary       string            `json:"summary,omitempty"`
+	Authors       []string          `json:",omitempty"`
+	Published     time.Time         `json:"published"`
+	Level         encode_level      `json:"level"`
+	Scores        map[int]float64   `json:"scores"`
+	Labels        map[string]string `json:"labels"`
+	Cover         []byte            `json:"cover"`
+	Parent        *encode_paper     `json:"parent"`
+	Extra         interface{}       `json:"extra"`
+	Ignored       string            `json:"-"`
+	secret        string
+}
+
+func TestMarshal(t *testing.T) {
+	paper := encode_paper{
+		Encode_base:   &Encode_base{CreatedBy: "ada"},
+		YearPublished: 1967,
+		Title:         "Dances",
+		Authors:       []string{"Frisch"},
+		Published:     time.Date(1967, 5, 1, 0, 0, 0, 0, time.UTC),
+		Level:         1,
+		Scores:        map[int]float64{2: 0.5, 10: 1},
+		Cover:         []byte("hi"),
+		Extra:         "note",
+		Ignored:       "x",
+		secret:        "y",
+	}
+
+	encoded, err := Marshal(paper, Snake_case)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"created_by":"ada","year_published":"1967","title":"Dances","authors":["Frisch"],"published":"1967-05-01T00:00:00Z","level":"high","scores":{"10":1,"2":0.5},"labels":null,"cover":"aGk=","parent":null,"extra":"note"}`
+	if string(encoded) != expected {
+		t.Errorf("Expected %s, got %s", expected, encoded)
+	}
+
+	// Without a naming it is encoding/json.
+	paper.Encode_base = nil
+	paper.Level = 0
+	encoded, _ = Marshal(paper, nil)
+	standard, _ := json.Marshal(paper)
+	if string(encoded) != string(standard) {
+		t.Errorf("Expected %s, got %s", standard, encoded)
+	}
+
+	// A Decoder with the same naming reads it back.
+	encoded, _ = Marshal(paper, Kebab_case)
+	var decoded encode_paper
+	if diagnostics := (Decoder{Key_naming: Kebab_case}).Decode(string(encoded), &decoded); diagnostics != nil {
+		t.Fatalf("Unexpected diagnostics: %v", diagnostics)
+	}
+	paper.Ignored, paper.secret = "", ""
+	if !reflect.DeepEqual(decoded, paper) {
+		t.Errorf("Expected %+v, got %+v", paper, decoded)
+	}
+}
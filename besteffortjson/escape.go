@@ -0,0 +1,115 @@
+package besteffortjson
+
+import (
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// escape_decoder decodes the escape sequences of a JSON string as RFC 8259
+// defines them, one character at a time. A sequence that is cut off by the end
+// of the stream simply hasn't been written yet. \' is accepted as well, for
+// single quoted strings.
+type escape_decoder struct {
+	in_unicode bool
+	hex        []rune
+
+	// high_surrogate is the first half of a surrogate pair, waiting for a
+	// \u escape with the second half.
+	high_surrogate rune
+}
+
+// feed takes the characters following a backslash and reports whether the
+// escape sequence is finished.
+func (e *escape_decoder) feed(char rune, out *strings.Builder) bool {
+	if !e.in_unicode {
+		if char == 'u' {
+			e.in_unicode = true
+			e.hex = e.hex[:0]
+			return false
+		}
+
+		e.flush(out)
+		switch char {
+		case '"', '\\', '/', '\'':
+			out.WriteRune(char)
+		case 'b':
+			out.WriteByte('\b')
+		case 'f':
+			out.WriteByte('\f')
+		case 'n':
+			out.WriteByte('\n')
+		case 'r':
+			out.WriteByte('\r')
+		case 't':
+			out.WriteByte('\t')
+		default:
+			out.WriteByte('\\')
+			out.WriteRune(char)
+		}
+		return true
+	}
+
+	if !is_hex(char) {
+		// Not a real \u escape, keep what the model wrote.
+		e.in_unicode = false
+		e.flush(out)
+		out.WriteString(`\u`)
+		out.WriteString(string(e.hex))
+		out.WriteRune(char)
+		return true
+	}
+
+	e.hex = append(e.hex, char)
+	if len(e.hex) < 4 {
+		return false
+	}
+	e.in_unicode = false
+
+	var code rune
+	for _, digit := range e.hex {
+		code = code<<4 | hex_value(digit)
+	}
+
+	switch {
+	case utf16.IsSurrogate(code) && code < 0xDC00:
+		e.flush(out)
+		e.high_surrogate = code
+	case utf16.IsSurrogate(code):
+		if e.high_surrogate != 0 {
+			out.WriteRune(utf16.DecodeRune(e.high_surrogate, code))
+			e.high_surrogate = 0
+		} else {
+			out.WriteRune(utf8.RuneError)
+		}
+	default:
+		e.flush(out)
+		out.WriteRune(code)
+	}
+
+	return true
+}
+
+// flush writes a high surrogate that never got its second half as U+FFFD.
+// It is called before any other character is written to the string.
+func (e *escape_decoder) flush(out *strings.Builder) {
+	if e.high_surrogate != 0 {
+		out.WriteRune(utf8.RuneError)
+		e.high_surrogate = 0
+	}
+}
+
+func is_hex(char rune) bool {
+	return (char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')
+}
+
+func hex_value(char rune) rune {
+	switch {
+	case char >= 'a':
+		return char - 'a' + 10
+	case char >= 'A':
+		return char - 'A' + 10
+	default:
+		return char - '0'
+	}
+}
@@ -0,0 +1,273 @@
+package besteffortjson
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+type scan_mode int
+
+const (
+	mode_seeking scan_mode = iota
+	mode_array_candidate
+	mode_parsing
+)
+
+// scanner is the part of a StreamParser that finds documents in the prose
+// around them, before anything is handed to the JSON state machine.
+type scanner struct {
+	mode    scan_mode
+	offset  int
+	pending []byte
+
+	line_start bool
+	// backticks counts the backticks at the start of the current line, which
+	// are held back until it is clear whether they open a fence.
+	backticks   int
+	reading_tag bool
+	fence_tag   strings.Builder
+	in_fence    bool
+	json_fence  bool
+
+	// A "[" in prose is only the start of a document if a value follows it,
+	// so "[citation needed]" isn't mistaken for an array.
+	candidate_start int
+	candidate_depth int
+}
+
+// Document is one JSON document found in a response. Start and End are byte
+// offsets into the response, so response[Start:End] is the raw text of the
+// document. End is only final once the document is Complete or another
+// document has started.
+type Document struct {
+	Start int
+	End   int
+	// Complete is set once the outermost object or array has been closed.
+	Complete bool
+	// Fenced is set for documents inside a ```json markdown fence.
+	Fenced bool
+
+	root *node
+}
+
+// Snapshot returns the document as valid JSON.
+func (d Document) Snapshot() string {
+	var buffer bytes.Buffer
+	d.root.encode(&buffer)
+	return buffer.String()
+}
+
+// Value returns the document as the same kind of values encoding/json
+// produces, except that integers are ints.
+func (d Document) Value() interface{} {
+	return d.root.value()
+}
+
+// Documents returns every document found so far, in the order they appear.
+// The last one may still be in progress.
+func (p *StreamParser) Documents() []Document {
+	result := make([]Document, len(p.documents))
+	for i, document := range p.documents {
+		result[i] = *document
+	}
+	return result
+}
+
+// Document returns the most plausible document found so far, the one Snapshot
+// and Value use. ok is false if no JSON has been found yet.
+func (p *StreamParser) Document() (document Document, ok bool) {
+	return p.best(), len(p.documents) > 0
+}
+
+// best picks the document most likely to be the answer: one in a ```json
+// fence, then the longest one, then the first one.
+func (p *StreamParser) best() Document {
+	var best *Document
+	for _, document := range p.documents {
+		switch {
+		case best == nil:
+			best = document
+		case document.Fenced != best.Fenced:
+			if document.Fenced {
+				best = document
+			}
+		case document.End-document.Start > best.End-best.Start:
+			best = document
+		}
+	}
+
+	if best == nil {
+		return Document{}
+	}
+	return *best
+}
+
+// Extract_json returns the raw text of the most plausible JSON document in
+// text, or "" if there is none. The document may be unfinished.
+func Extract_json(text string) string {
+	parser := NewStreamParser()
+	parser.Options = Lenient
+	parser.Write(text)
+	if len(parser.documents) == 0 {
+		return ""
+	}
+
+	best := parser.best()
+	return text[best.Start:best.End]
+}
+
+// Extract_all_json returns the raw text of every JSON document in text.
+func Extract_all_json(text string) []string {
+	parser := NewStreamParser()
+	parser.Options = Lenient
+	parser.Write(text)
+
+	var result []string
+	for _, document := range parser.documents {
+		result = append(result, text[document.Start:document.End])
+	}
+	return result
+}
+
+func (p *StreamParser) scan(char rune, size int) {
+	if p.reading_tag {
+		if char == '\n' {
+			p.toggle_fence()
+			p.line_start = true
+			return
+		}
+		p.fence_tag.WriteRune(char)
+		return
+	}
+
+	if p.line_start {
+		switch {
+		case char == '`':
+			p.backticks++
+			if p.backticks == 3 {
+				p.start_fence()
+			}
+			return
+		case (char == ' ' || char == '\t' || char == '\r') && p.backticks == 0:
+			p.scan_char(char, size)
+			return
+		case char != '\n':
+			p.line_start = false
+		}
+		p.flush_backticks()
+	}
+
+	if char == '\n' {
+		p.line_start = true
+	}
+	p.scan_char(char, size)
+}
+
+// start_fence ends whatever document is in progress, since JSON doesn't carry
+// on past a fence, and starts reading the language tag of the fence.
+func (p *StreamParser) start_fence() {
+	p.backticks = 0
+	p.reading_tag = true
+	p.fence_tag.Reset()
+
+	if p.current != nil {
+		p.finish_document(false)
+	}
+	p.mode = mode_seeking
+}
+
+func (p *StreamParser) toggle_fence() {
+	p.reading_tag = false
+	if p.in_fence {
+		p.in_fence = false
+		p.json_fence = false
+		return
+	}
+
+	p.in_fence = true
+	tag := strings.ToLower(strings.TrimSpace(p.fence_tag.String()))
+	p.json_fence = strings.HasPrefix(tag, "json")
+}
+
+// flush_backticks passes on backticks that turned out not to be a fence.
+func (p *StreamParser) flush_backticks() {
+	for ; p.backticks > 0; p.backticks-- {
+		p.scan_char('`', 1)
+	}
+}
+
+func (p *StreamParser) scan_char(char rune, size int) {
+	switch p.mode {
+	case mode_seeking:
+		switch char {
+		case '{':
+			p.begin_document(p.offset)
+			p.feed_document(char, size)
+		case '[':
+			p.mode = mode_array_candidate
+			p.candidate_start = p.offset
+			p.candidate_depth = 1
+		}
+	case mode_array_candidate:
+		switch {
+		case char == '[':
+			p.candidate_depth++
+		case unicode.IsSpace(char):
+		case p.can_start_array_item(char):
+			p.begin_document(p.candidate_start)
+			for ; p.candidate_depth > 0; p.candidate_depth-- {
+				p.feed('[')
+			}
+			p.feed_document(char, size)
+		default:
+			p.mode = mode_seeking
+			p.scan_char(char, size)
+		}
+	case mode_parsing:
+		p.feed_document(char, size)
+	}
+}
+
+func (p *StreamParser) can_start_array_item(char rune) bool {
+	switch {
+	case strings.ContainsRune(`{]"-.tfn`, char) || (char >= '0' && char <= '9'):
+		return true
+	case char == '\'':
+		return p.Options.Single_quotes
+	case strings.ContainsRune("TFNIu", char):
+		return p.Options.Literal_variants
+	}
+	return false
+}
+
+func (p *StreamParser) begin_document(start int) {
+	p.current = &Document{Start: start, End: start, Fenced: p.in_fence && p.json_fence}
+	p.documents = append(p.documents, p.current)
+	p.mode = mode_parsing
+
+	p.state = state_value
+	p.stack = p.stack[:0]
+	p.scalar = nil
+	p.key.Reset()
+	p.escape = escape_decoder{}
+	p.quote = 0
+	p.comment_return = state_value
+	p.previous_char = 0
+}
+
+func (p *StreamParser) feed_document(char rune, size int) {
+	p.feed(char)
+	if !unicode.IsSpace(char) {
+		p.current.End = p.offset + size
+	}
+	if p.state == state_done {
+		p.finish_document(true)
+	}
+}
+
+func (p *StreamParser) finish_document(complete bool) {
+	p.current.Complete = complete
+	p.current = nil
+	p.mode = mode_seeking
+}
@@ -0,0 +1,105 @@
+package besteffortjson
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBest_effort_json_parse_extraction(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			"top level array",
+			`[{"name": "Ada"}, {"name": "Grace"}]`,
+			`[{"name":"Ada"},{"name":"Grace"}]`,
+		},
+		{
+			"object starting mid sentence",
+			`Here you go: {"name": "Ada", "year": 18`,
+			`{"name":"Ada","year":18}`,
+		},
+		{
+			"array starting mid sentence",
+			"The years are [1815, 1906] as requested.",
+			`[1815,1906]`,
+		},
+		{
+			"fenced json after prose",
+			"Sure, here it is:\n```json\n{\"name\": \"Ada\"}\n```\nAnything else?",
+			`{"name":"Ada"}`,
+		},
+		{
+			"unfinished fenced json",
+			"Sure, here it is:\n```json\n[{\"name\": \"Ada\"}, {\"na",
+			`[{"name":"Ada"},{}]`,
+		},
+		{
+			"square brackets in prose are not arrays",
+			"As shown before [citation needed], the answer is {\"a\": 1}",
+			`{"a":1}`,
+		},
+		{
+			"curly example in prose before the answer",
+			"Use {name} as a placeholder. The result:\n\n{\"results\": [{\"name\": \"Ada\"}]}",
+			`{"results":[{"name":"Ada"}]}`,
+		},
+		{
+			"json fence wins over a longer unfenced document",
+			"For example {\"example\": \"a long value to make this longer\"}\n```json\n{\"a\": 1}\n```",
+			`{"a":1}`,
+		},
+		{
+			"no json",
+			"I'm sorry, I can't help with that [yet].",
+			`null`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if result := Best_effort_json_parse(tc.input); result != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestExtract_json(t *testing.T) {
+	text := "First {\"a\": 1} then\n```json\n[1, 2,\n```\nand finally {\"b\": 'two'}"
+
+	if result := Extract_json(text); result != "[1, 2," {
+		t.Errorf("Expected the fenced document, got %q", result)
+	}
+
+	expected := []string{`{"a": 1}`, "[1, 2,", `{"b": 'two'}`}
+	if result := Extract_all_json(text); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+
+	if result := Extract_json("no json here"); result != "" {
+		t.Errorf("Expected no document, got %q", result)
+	}
+}
+
+func TestStreamParser_Documents(t *testing.T) {
+	parser := NewStreamParser()
+	parser.Write("One {\"a\": 1}, two [true, fal")
+
+	documents := parser.Documents()
+	if len(documents) != 2 {
+		t.Fatalf("Expected 2 documents, got %d", len(documents))
+	}
+
+	if !documents[0].Complete || documents[0].Snapshot() != `{"a":1}` {
+		t.Errorf("Expected a complete first document, got %+v %s", documents[0], documents[0].Snapshot())
+	}
+	if documents[1].Complete || documents[1].Snapshot() != `[true,false]` {
+		t.Errorf("Expected an unfinished second document, got %+v %s", documents[1], documents[1].Snapshot())
+	}
+	if documents[1].Start != 18 || documents[1].End != 28 {
+		t.Errorf("Expected the second document at 18:28, got %d:%d", documents[1].Start, documents[1].End)
+	}
+}
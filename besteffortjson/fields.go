@@ -0,0 +1,215 @@
+package besteffortjson
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Field is a struct field the way encoding/json sees it.
+type Field struct {
+	// Name is the JSON key: the name in the json tag, or else the Go name
+	// passed through the Key_naming.
+	Name string
+	// Index leads to the field through embedded structs, as for
+	// reflect.Value.FieldByIndex.
+	Index        []int
+	Struct_field reflect.StructField
+	// Omitempty is set by the ",omitempty" tag option: the field may be
+	// left out.
+	Omitempty bool
+	// Quoted is set by the ",string" tag option: a number or bool is
+	// written as a JSON string.
+	Quoted bool
+}
+
+// Fields lists the JSON fields of a struct type in declaration order. Like
+// encoding/json it skips unexported fields and fields tagged "-", and
+// promotes the fields of embedded structs without a tag name. Of the fields
+// with the same name only the shallowest are kept, and of those the one with
+// a tag name; a name still shared by several fields is left out. A nil
+// naming means Verbatim.
+func Fields(t reflect.Type, naming Key_naming) []Field {
+	if naming == nil {
+		naming = Verbatim
+	}
+
+	var candidates []field_candidate
+	collect_fields(t, naming, nil, map[reflect.Type]bool{}, &candidates)
+
+	dominant := make(map[string]*field_candidate)
+	ambiguous := make(map[string]bool)
+	for i := range candidates {
+		candidate := &candidates[i]
+		current, seen := dominant[candidate.Name]
+		switch {
+		case !seen || len(candidate.Index) < len(current.Index):
+			dominant[candidate.Name] = candidate
+			ambiguous[candidate.Name] = false
+		case len(candidate.Index) > len(current.Index):
+		case candidate.tagged && !current.tagged:
+			dominant[candidate.Name] = candidate
+			ambiguous[candidate.Name] = false
+		case candidate.tagged == current.tagged:
+			ambiguous[candidate.Name] = true
+		}
+	}
+
+	var fields []Field
+	for i := range candidates {
+		candidate := &candidates[i]
+		if dominant[candidate.Name] == candidate && !ambiguous[candidate.Name] {
+			fields = append(fields, candidate.Field)
+		}
+	}
+	return fields
+}
+
+// field_candidate is a field that may be hidden by another with the same
+// name. tagged is set when its name comes from a json tag.
+type field_candidate struct {
+	Field
+	tagged bool
+}
+
+func collect_fields(t reflect.Type, naming Key_naming, index []int, visiting map[reflect.Type]bool, candidates *[]field_candidate) {
+	if visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		struct_field := t.Field(i)
+		tag := struct_field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, tag_options, _ := strings.Cut(tag, ",")
+		field_index := append(append([]int(nil), index...), i)
+
+		if struct_field.Anonymous && name == "" {
+			embedded := struct_field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				// Pointers to unexported structs can't be allocated, but
+				// the fields of unexported structs are promoted.
+				if struct_field.Type.Kind() != reflect.Pointer || struct_field.IsExported() {
+					collect_fields(embedded, naming, field_index, visiting, candidates)
+				}
+				continue
+			}
+		}
+		if !struct_field.IsExported() {
+			continue
+		}
+
+		tagged := name != ""
+		if !tagged {
+			name = naming(struct_field.Name)
+		}
+		*candidates = append(*candidates, field_candidate{
+			Field: Field{
+				Name:         name,
+				Index:        field_index,
+				Struct_field: struct_field,
+				Omitempty:    has_tag_option(tag_options, "omitempty"),
+				Quoted:       has_tag_option(tag_options, "string"),
+			},
+			tagged: tagged,
+		})
+	}
+}
+
+func has_tag_option(options string, option string) bool {
+	for options != "" {
+		var current string
+		current, options, _ = strings.Cut(options, ",")
+		if current == option {
+			return true
+		}
+	}
+	return false
+}
+
+type fields_key struct {
+	t      reflect.Type
+	naming uintptr
+}
+
+var fields_cache sync.Map
+
+// builtin_namings are the namings cached_fields caches, by code pointer.
+// Closures made by the same function literal share their code pointer, so
+// other namings can't be told apart by it.
+var builtin_namings = map[uintptr]bool{
+	reflect.ValueOf(Verbatim).Pointer():   true,
+	reflect.ValueOf(Snake_case).Pointer(): true,
+	reflect.ValueOf(Kebab_case).Pointer(): true,
+	reflect.ValueOf(Camel_case).Pointer(): true,
+}
+
+// cached_fields is Fields for the decoder, which looks up the same types on
+// every snapshot of a stream. Only the built-in namings are cached.
+func cached_fields(t reflect.Type, naming Key_naming) []Field {
+	key := fields_key{t: t}
+	if naming != nil {
+		key.naming = reflect.ValueOf(naming).Pointer()
+		if !builtin_namings[key.naming] {
+			return Fields(t, naming)
+		}
+	}
+	if fields, ok := fields_cache.Load(key); ok {
+		return fields.([]Field)
+	}
+	fields, _ := fields_cache.LoadOrStore(key, Fields(t, naming))
+	return fields.([]Field)
+}
+
+// find_field matches a key to a field like encoding/json does: exactly, or
+// else ignoring case. As a last resort it also ignores underscores and
+// dashes, so a model that names a key in a different case style is still
+// understood.
+func find_field(fields []Field, key string) (Field, bool) {
+	for _, field := range fields {
+		if field.Name == key {
+			return field, true
+		}
+	}
+	for _, field := range fields {
+		if strings.EqualFold(field.Name, key) {
+			return field, true
+		}
+	}
+
+	key = strip_separators(key)
+	for _, field := range fields {
+		if strings.EqualFold(strip_separators(field.Name), key) {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+var separator_remover = strings.NewReplacer("_", "", "-", "")
+
+func strip_separators(key string) string {
+	return separator_remover.Replace(key)
+}
+
+// field_by_index is reflect.Value.FieldByIndex that allocates nil embedded
+// struct pointers on the way.
+func field_by_index(v reflect.Value, index []int) reflect.Value {
+	for i, field := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(field)
+	}
+	return v
+}
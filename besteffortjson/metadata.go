@@ -0,0 +1,133 @@
+package besteffortjson
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Metadata tells which parts of a best-effort parse were actually received
+// and which were cut off by the end of the stream.
+type Metadata struct {
+	// Complete maps the JSON Pointer (RFC 6901) of every value in the
+	// document to whether the value was closed. The root is "". A string
+	// without its closing quote, an object or array without its closing
+	// bracket and a number or literal that may still go on are all false.
+	Complete map[string]bool
+	// Offset is the byte offset in the response just past the last part of
+	// the document that was parsed.
+	Offset int
+}
+
+// Metadata returns the completeness of every value in the document.
+func (d Document) Metadata() Metadata {
+	metadata := Metadata{Complete: make(map[string]bool), Offset: d.End}
+	if d.root != nil {
+		d.root.collect_metadata("", metadata.Complete)
+	}
+	return metadata
+}
+
+// Is_complete looks up a single JSON Pointer. found is false if the document
+// has no value there yet.
+func (d Document) Is_complete(pointer string) (complete bool, found bool) {
+	n := d.root.lookup(pointer)
+	if n == nil {
+		return false, false
+	}
+	return n.complete, true
+}
+
+// Is_object reports whether the value at a JSON Pointer is an object.
+func (d Document) Is_object(pointer string) bool {
+	n := d.root.lookup(pointer)
+	return n != nil && n.kind == kind_object
+}
+
+// Is_array reports whether the value at a JSON Pointer is an array.
+func (d Document) Is_array(pointer string) bool {
+	n := d.root.lookup(pointer)
+	return n != nil && n.kind == kind_array
+}
+
+// Metadata returns the completeness of the most plausible document parsed so
+// far, the same one Snapshot returns.
+func (p *StreamParser) Metadata() Metadata {
+	return p.best().Metadata()
+}
+
+// Is_complete looks up a single JSON Pointer in the most plausible document
+// parsed so far. It is cheap enough to call on every chunk.
+func (p *StreamParser) Is_complete(pointer string) (complete bool, found bool) {
+	return p.best().Is_complete(pointer)
+}
+
+// Best_effort_json_parse_with_metadata is Best_effort_json_parse_with_options
+// that also returns which parts of the result were complete.
+func Best_effort_json_parse_with_metadata(in_progress string, options Options) (string, Metadata) {
+	parser := NewStreamParser()
+	parser.Options = options
+	parser.Write(in_progress)
+	return parser.Snapshot(), parser.Metadata()
+}
+
+func (n *node) collect_metadata(pointer string, complete map[string]bool) {
+	complete[pointer] = n.complete
+
+	switch n.kind {
+	case kind_object:
+		for _, key := range n.keys {
+			child_pointer := pointer + "/" + escape_pointer_token(key)
+			if child := n.fields[key]; child != nil {
+				child.collect_metadata(child_pointer, complete)
+			} else {
+				// The key and colon arrived but the value didn't.
+				complete[child_pointer] = false
+			}
+		}
+	case kind_array:
+		for i, item := range n.items {
+			item.collect_metadata(pointer+"/"+strconv.Itoa(i), complete)
+		}
+	}
+}
+
+// lookup finds the node a JSON Pointer refers to, or nil.
+func (n *node) lookup(pointer string) *node {
+	if pointer == "" || n == nil {
+		return n
+	}
+	if pointer[0] != '/' {
+		return nil
+	}
+
+	token, rest, nested := strings.Cut(pointer[1:], "/")
+	if nested {
+		rest = "/" + rest
+	}
+
+	switch n.kind {
+	case kind_object:
+		return n.fields[unescape_pointer_token(token)].lookup(rest)
+	case kind_array:
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(n.items) {
+			return nil
+		}
+		return n.items[index].lookup(rest)
+	default:
+		return nil
+	}
+}
+
+var (
+	pointer_escaper   = strings.NewReplacer("~", "~0", "/", "~1")
+	pointer_unescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+func escape_pointer_token(token string) string {
+	return pointer_escaper.Replace(token)
+}
+
+func unescape_pointer_token(token string) string {
+	return pointer_unescaper.Replace(token)
+}
@@ -0,0 +1,95 @@
+package besteffortjson
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBest_effort_json_parse_with_metadata(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected Metadata
+	}{
+		{
+			"unfinished string that looks closed",
+			`{"ids": ["123]`,
+			Metadata{Offset: 14, Complete: map[string]bool{
+				"": false, "/ids": false, "/ids/0": false,
+			}},
+		},
+		{
+			"finished and unfinished items",
+			"Here: {\"results\": [{\"name\": \"Ada\", \"age\": 36}, {\"name\": \"Gr",
+			Metadata{Offset: 59, Complete: map[string]bool{
+				"":                false,
+				"/results":        false,
+				"/results/0":      true,
+				"/results/0/name": true,
+				"/results/0/age":  true,
+				"/results/1":      false,
+				"/results/1/name": false,
+			}},
+		},
+		{
+			"number that may go on and a key without a value",
+			`{"a/b": 12, "c~d": 3.5, "e": `,
+			Metadata{Offset: 28, Complete: map[string]bool{
+				"": false, "/a~1b": true, "/c~0d": true, "/e": false,
+			}},
+		},
+		{
+			"complete document ignores trailing prose",
+			"{\"a\": [1, 2]}\nHope that helps!",
+			Metadata{Offset: 13, Complete: map[string]bool{
+				"": true, "/a": true, "/a/0": true, "/a/1": true,
+			}},
+		},
+		{
+			"no json",
+			"Nothing to see",
+			Metadata{Complete: map[string]bool{}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, metadata := Best_effort_json_parse_with_metadata(tc.input, Lenient)
+			if !reflect.DeepEqual(metadata, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, metadata)
+			}
+		})
+	}
+}
+
+func TestStreamParser_Is_complete(t *testing.T) {
+	parser := NewStreamParser()
+	parser.Write(`{"results": [{"name": "Ada"}, {"name": 4`)
+
+	testCases := []struct {
+		pointer  string
+		complete bool
+		found    bool
+	}{
+		{"", false, true},
+		{"/results/0", true, true},
+		{"/results/0/name", true, true},
+		{"/results/1/name", false, true},
+		{"/results/2", false, false},
+		{"/results/x", false, false},
+		{"/missing", false, false},
+		{"results", false, false},
+	}
+
+	for _, tc := range testCases {
+		complete, found := parser.Is_complete(tc.pointer)
+		if complete != tc.complete || found != tc.found {
+			t.Errorf("Is_complete(%q): expected %v %v, got %v %v", tc.pointer, tc.complete, tc.found, complete, found)
+		}
+	}
+
+	document, _ := parser.Document()
+	if !document.Is_array("/results") || document.Is_array("") || !document.Is_object("") || !document.Is_object("/results/1") || document.Is_object("/missing") {
+		t.Errorf("Expected Is_array and Is_object to look at the kind of the value")
+	}
+}
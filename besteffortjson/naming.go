@@ -0,0 +1,74 @@
+package besteffortjson
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Key_naming turns a Go field name into the JSON key of a field that has no
+// name in its json tag. The same naming has to be used for the schema shown
+// to the model and for decoding its answer.
+type Key_naming func(field_name string) string
+
+// Snake_case names YearPublished year_published.
+func Snake_case(field_name string) string {
+	return strings.ToLower(strings.Join(split_words(field_name), "_"))
+}
+
+// Kebab_case names YearPublished year-published.
+func Kebab_case(field_name string) string {
+	return strings.ToLower(strings.Join(split_words(field_name), "-"))
+}
+
+// Camel_case names YearPublished yearPublished.
+func Camel_case(field_name string) string {
+	var builder strings.Builder
+	for i, word := range split_words(field_name) {
+		word = strings.ToLower(word)
+		if i > 0 {
+			first := []rune(word)[0]
+			word = string(unicode.ToUpper(first)) + word[len(string(first)):]
+		}
+		builder.WriteString(word)
+	}
+	return builder.String()
+}
+
+// Verbatim keeps the Go field name, like encoding/json does.
+func Verbatim(field_name string) string {
+	return field_name
+}
+
+// split_words splits an identifier at underscores, spaces and other
+// punctuation and where the case changes, keeping acronyms together:
+// HTTPServerID is HTTP, Server and ID.
+func split_words(name string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, string(word))
+			word = word[:0]
+		}
+	}
+
+	runes := []rune(name)
+	for i, char := range runes {
+		if !unicode.IsLetter(char) && !unicode.IsDigit(char) {
+			flush()
+			continue
+		}
+
+		if unicode.IsUpper(char) && len(word) > 0 {
+			previous := runes[i-1]
+			next_is_lower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(previous) || next_is_lower {
+				flush()
+			}
+		}
+		word = append(word, char)
+	}
+	flush()
+
+	return words
+}
@@ -0,0 +1,162 @@
+package besteffortjson
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestKey_naming(t *testing.T) {
+	testCases := []struct {
+		input string
+		snake string
+		camel string
+		kebab string
+	}{
+		{"YearPublished", "year_published", "yearPublished", "year-published"},
+		{"Followup_questions", "followup_questions", "followupQuestions", "followup-questions"},
+		{"HTTPServerID", "http_server_id", "httpServerId", "http-server-id"},
+		{"Line2Text", "line2_text", "line2Text", "line2-text"},
+		{"hello world", "hello_world", "helloWorld", "hello-world"},
+		{"Über", "über", "über", "über"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			if result := Snake_case(tc.input); result != tc.snake {
+				t.Errorf("Snake_case: expected %s, got %s", tc.snake, result)
+			}
+			if result := Camel_case(tc.input); result != tc.camel {
+				t.Errorf("Camel_case: expected %s, got %s", tc.camel, result)
+			}
+			if result := Kebab_case(tc.input); result != tc.kebab {
+				t.Errorf("Kebab_case: expected %s, got %s", tc.kebab, result)
+			}
+			if result := Verbatim(tc.input); result != tc.input {
+				t.Errorf("Verbatim: expected %s, got %s", tc.input, result)
+			}
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	type Base struct {
+		ID      int
+		Name    string
+		Created string `json:"created_at"`
+	}
+	type Record struct {
+		*Base
+		Name     string `json:"title"`
+		ID       int    `json:",string"`
+		Internal string `json:"-"`
+		Note     string `json:"note,omitempty"`
+		hidden   string
+	}
+
+	var names []string
+	for _, field := range Fields(reflect.TypeOf(Record{}), Snake_case) {
+		names = append(names, field.Name)
+	}
+	expected := []string{"name", "created_at", "title", "id", "note"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+
+	fields := Fields(reflect.TypeOf(Record{}), nil)
+	if fields[0].Name != "Name" || !reflect.DeepEqual(fields[0].Index, []int{0, 1}) {
+		t.Errorf("Expected the promoted Name field, got %+v", fields[0])
+	}
+	if !fields[3].Quoted || !fields[4].Omitempty {
+		t.Errorf("Expected tag options to be read, got %+v", fields)
+	}
+}
+
+type Conflict_a struct {
+	Name string
+}
+
+type Conflict_b struct {
+	Name string
+}
+
+type Conflict_tagged struct {
+	Name string `json:"Name"`
+}
+
+func TestFields_conflicts(t *testing.T) {
+	// Like encoding/json, a name two embedded structs share at the same
+	// depth is left out, unless only one of them is tagged with it.
+	ambiguous := struct {
+		Conflict_a
+		Conflict_b
+		Other string
+	}{Conflict_a{"a"}, Conflict_b{"b"}, "o"}
+	tagged := struct {
+		Conflict_a
+		Conflict_tagged
+		Other string
+	}{Conflict_a{"a"}, Conflict_tagged{"t"}, "o"}
+
+	for _, value := range []interface{}{ambiguous, tagged} {
+		encoded, err := Marshal(value, nil)
+		standard, _ := json.Marshal(value)
+		if err != nil || string(encoded) != string(standard) {
+			t.Errorf("Expected %s, got %s (%v)", standard, encoded, err)
+		}
+	}
+
+	var decoded struct {
+		Conflict_a
+		Conflict_tagged
+	}
+	(Decoder{}).Decode(`{"Name": "t"}`, &decoded)
+	if decoded.Conflict_a.Name != "" || decoded.Conflict_tagged.Name != "t" {
+		t.Errorf("Expected the tagged field to be decoded, got %+v", decoded)
+	}
+}
+
+func TestDecoder_key_naming(t *testing.T) {
+	type Paper struct {
+		YearPublished int
+		FullTitle     string `json:"title"`
+		PageCount     int    `json:",string"`
+	}
+
+	var paper Paper
+	decoder := Decoder{Key_naming: Camel_case}
+	diagnostics := decoder.Decode(`{"yearPublished": 1905, "title": "On the Electrodynamics", "pageCount": "31"}`, &paper)
+	expected := Paper{YearPublished: 1905, FullTitle: "On the Electrodynamics", PageCount: 31}
+	if len(diagnostics) > 0 || paper != expected {
+		t.Errorf("Expected %+v, got %+v %v", expected, paper, diagnostics)
+	}
+
+	paper = Paper{}
+	decoder.Decode(`{"year_published": 1905}`, &paper)
+	if paper.YearPublished != 1905 {
+		t.Errorf("Expected keys in another case style to still match, got %+v", paper)
+	}
+}
+
+func TestDecoder_key_naming_closures(t *testing.T) {
+	type Person struct {
+		FullName string
+	}
+	prefix := func(p string) Key_naming {
+		return func(name string) string { return p + Snake_case(name) }
+	}
+
+	// Both namings come from the same function literal, so the fields of
+	// one must not be reused for the other.
+	var a, b Person
+	(Decoder{Key_naming: prefix("a_")}).Decode(`{"a_full_name": "Ada"}`, &a)
+	(Decoder{Key_naming: prefix("b_")}).Decode(`{"a_full_name": "Ada", "b_full_name": "Bea"}`, &b)
+	if a.FullName != "Ada" || b.FullName != "Bea" {
+		t.Errorf("Expected each naming to be used, got %+v and %+v", a, b)
+	}
+
+	encoded, err := Marshal(Person{FullName: "Bea"}, prefix("b_"))
+	if err != nil || string(encoded) != `{"b_full_name":"Bea"}` {
+		t.Errorf("Expected %s, got %s (%v)", `{"b_full_name":"Bea"}`, encoded, err)
+	}
+}
@@ -0,0 +1,32 @@
+package besteffortjson
+
+// Options enables the lenient parts of the JSON dialect models tend to write.
+// Trailing commas in arrays and objects are always accepted.
+type Options struct {
+	// Comments skips // line and /* block */ comments.
+	Comments bool
+	// Single_quotes accepts 'single quoted' strings and keys.
+	Single_quotes bool
+	// Unquoted_keys accepts bare identifiers as object keys.
+	Unquoted_keys bool
+	// Literal_variants accepts True/False/None and other spellings of the
+	// JSON literals, and turns NaN, Infinity and undefined into null.
+	Literal_variants bool
+}
+
+// Lenient enables every option.
+var Lenient = Options{
+	Comments:         true,
+	Single_quotes:    true,
+	Unquoted_keys:    true,
+	Literal_variants: true,
+}
+
+// Best_effort_json_parse_with_options is Best_effort_json_parse with the
+// given dialect options.
+func Best_effort_json_parse_with_options(in_progress string, options Options) string {
+	parser := NewStreamParser()
+	parser.Options = options
+	parser.Write(in_progress)
+	return parser.Snapshot()
+}
@@ -0,0 +1,483 @@
+package besteffortjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type node_kind int
+
+const (
+	kind_object node_kind = iota
+	kind_array
+	kind_string
+	kind_number
+	kind_literal
+)
+
+// node is one value of the document being parsed. Scalars keep their raw text
+// so a value that is still streaming can be read at any point.
+type node struct {
+	kind     node_kind
+	keys     []string
+	fields   map[string]*node
+	items    []*node
+	text     strings.Builder
+	complete bool
+	// replaced counts the fields of an object set again by a duplicate key,
+	// which changes a value without adding a key.
+	replaced int
+
+	// literal_variants accepts True, FALSE, None and so on for literals.
+	literal_variants bool
+
+	// encoded caches the JSON of a complete node so snapshots don't have to
+	// encode finished parts of the document again.
+	encoded []byte
+}
+
+type parse_state int
+
+const (
+	state_value parse_state = iota
+	state_key_or_end
+	state_key
+	state_key_escape
+	state_colon
+	state_string
+	state_string_escape
+	state_token
+	state_bare_key
+	state_comment_start
+	state_line_comment
+	state_block_comment
+	state_done
+)
+
+// StreamParser is a best-effort JSON parser that is fed a response one chunk
+// at a time. It keeps its parse state between chunks, so every character is
+// only looked at once, and Snapshot can be called at any point to get the
+// document parsed so far.
+//
+// JSON documents are picked out of the surrounding prose wherever they start,
+// including inside markdown fences. When a response contains several, Snapshot
+// and Value use the most plausible one and Documents returns all of them.
+// Options must be set before the first Write.
+type StreamParser struct {
+	Options Options
+
+	scanner
+	documents []*Document
+	current   *Document
+
+	state  parse_state
+	stack  []*node
+	scalar *node
+	key    strings.Builder
+	escape escape_decoder
+	quote  rune
+
+	comment_return parse_state
+	previous_char  rune
+}
+
+func NewStreamParser() *StreamParser {
+	return &StreamParser{scanner: scanner{line_start: true}}
+}
+
+// Write feeds the next chunk of the response to the parser. A multi-byte
+// character split across chunks is held back until the rest of it arrives.
+func (p *StreamParser) Write(chunk string) {
+	data := chunk
+	if len(p.pending) > 0 {
+		data = string(p.pending) + chunk
+		p.pending = p.pending[:0]
+	}
+
+	for len(data) > 0 {
+		char, size := utf8.DecodeRuneInString(data)
+		if char == utf8.RuneError && size == 1 && !utf8.FullRuneInString(data) {
+			p.pending = append(p.pending, data...)
+			return
+		}
+
+		p.scan(char, size)
+		p.offset += size
+		data = data[size:]
+	}
+}
+
+// Snapshot returns the most plausible document parsed so far as JSON, or
+// "null" if no JSON has been found yet.
+func (p *StreamParser) Snapshot() string {
+	return p.best().Snapshot()
+}
+
+// Value returns the most plausible document parsed so far as the same kind of
+// values encoding/json produces, except that integers are ints.
+func (p *StreamParser) Value() interface{} {
+	return p.best().Value()
+}
+
+func (p *StreamParser) feed(char rune) {
+	previous_char := p.previous_char
+	p.previous_char = char
+
+	if p.Options.Comments && char == '/' && p.can_start_comment() {
+		if p.state == state_token {
+			p.complete_scalar()
+		}
+		p.comment_return = p.state
+		p.state = state_comment_start
+		return
+	}
+
+	switch p.state {
+	case state_done:
+	case state_comment_start:
+		switch char {
+		case '/':
+			p.state = state_line_comment
+		case '*':
+			p.state = state_block_comment
+			p.previous_char = 0
+		default:
+			p.state = p.comment_return
+			p.feed(char)
+		}
+	case state_line_comment:
+		if char == '\n' {
+			p.state = p.comment_return
+		}
+	case state_block_comment:
+		if previous_char == '*' && char == '/' {
+			p.state = p.comment_return
+		}
+	case state_string:
+		switch char {
+		case '\\':
+			p.state = state_string_escape
+		case p.quote:
+			p.escape.flush(&p.scalar.text)
+			p.complete_scalar()
+		default:
+			p.escape.flush(&p.scalar.text)
+			p.scalar.text.WriteRune(char)
+		}
+	case state_string_escape:
+		if p.escape.feed(char, &p.scalar.text) {
+			p.state = state_string
+		}
+	case state_token:
+		if is_token_end(char) {
+			p.complete_scalar()
+			p.feed(char)
+			return
+		}
+		p.scalar.text.WriteRune(char)
+	case state_key_or_end:
+		switch {
+		case char == '"' || (char == '\'' && p.Options.Single_quotes):
+			p.key.Reset()
+			p.quote = char
+			p.state = state_key
+		case char == '}':
+			p.close_container()
+		case p.Options.Unquoted_keys && is_identifier(char):
+			p.key.Reset()
+			p.key.WriteRune(char)
+			p.state = state_bare_key
+		}
+	case state_key:
+		switch char {
+		case '\\':
+			p.state = state_key_escape
+		case p.quote:
+			p.escape.flush(&p.key)
+			p.state = state_colon
+		default:
+			p.escape.flush(&p.key)
+			p.key.WriteRune(char)
+		}
+	case state_key_escape:
+		if p.escape.feed(char, &p.key) {
+			p.state = state_key
+		}
+	case state_bare_key:
+		switch {
+		case is_identifier(char):
+			p.key.WriteRune(char)
+		case char == '}':
+			p.close_container()
+		default:
+			p.state = state_colon
+			p.feed(char)
+		}
+	case state_colon:
+		switch char {
+		case ':':
+			p.top().set_field(p.key.String(), nil)
+			p.state = state_value
+		case '}':
+			p.close_container()
+		}
+	case state_value:
+		p.start_value(char)
+	}
+}
+
+// can_start_comment reports whether a '/' would be outside of any string.
+func (p *StreamParser) can_start_comment() bool {
+	switch p.state {
+	case state_string, state_string_escape, state_key, state_key_escape,
+		state_comment_start, state_line_comment, state_block_comment, state_done:
+		return false
+	}
+	return true
+}
+
+func (p *StreamParser) start_value(char rune) {
+	top := p.top()
+	in_object := top != nil && top.kind == kind_object
+	in_array := top != nil && top.kind == kind_array
+
+	switch {
+	case char == ' ' || char == '\n' || char == '\t' || char == '\r':
+	case char == ',':
+		if in_object {
+			p.state = state_key_or_end
+		}
+	case char == '}':
+		if in_object {
+			p.close_container()
+		}
+	case char == ']':
+		if in_array {
+			p.close_container()
+		}
+	case char == '{':
+		p.push(&node{kind: kind_object, fields: make(map[string]*node)})
+		p.state = state_key_or_end
+	case char == '[':
+		p.push(&node{kind: kind_array})
+		p.state = state_value
+	case char == '"' || (char == '\'' && p.Options.Single_quotes):
+		p.scalar = &node{kind: kind_string}
+		p.quote = char
+		p.attach(p.scalar)
+		p.state = state_string
+	default:
+		kind := kind_literal
+		if (char >= '0' && char <= '9') || char == '-' || char == '.' || char == '+' {
+			kind = kind_number
+		}
+		p.scalar = &node{kind: kind, literal_variants: p.Options.Literal_variants}
+		p.scalar.text.WriteRune(char)
+		p.attach(p.scalar)
+		p.state = state_token
+	}
+}
+
+func (p *StreamParser) top() *node {
+	if len(p.stack) == 0 {
+		return nil
+	}
+	return p.stack[len(p.stack)-1]
+}
+
+func (p *StreamParser) attach(child *node) {
+	top := p.top()
+	switch {
+	case top == nil:
+		p.current.root = child
+	case top.kind == kind_array:
+		top.items = append(top.items, child)
+	case top.kind == kind_object:
+		top.set_field(p.key.String(), child)
+	}
+}
+
+func (p *StreamParser) push(container *node) {
+	p.attach(container)
+	p.stack = append(p.stack, container)
+}
+
+func (p *StreamParser) close_container() {
+	p.top().complete = true
+	p.stack = p.stack[:len(p.stack)-1]
+	p.after_value()
+}
+
+func (p *StreamParser) complete_scalar() {
+	p.scalar.complete = true
+	p.scalar = nil
+	p.after_value()
+}
+
+func (p *StreamParser) after_value() {
+	top := p.top()
+	switch {
+	case top == nil:
+		p.state = state_done
+	case top.kind == kind_object:
+		p.state = state_key_or_end
+	default:
+		p.state = state_value
+	}
+}
+
+func (n *node) set_field(key string, value *node) {
+	// The key is set to nil at its colon and then to its value.
+	if existing, exists := n.fields[key]; !exists {
+		n.keys = append(n.keys, key)
+	} else if existing != nil {
+		n.replaced++
+	}
+	n.fields[key] = value
+}
+
+func is_identifier(char rune) bool {
+	return char == '_' || char == '$' || char == '-' || unicode.IsLetter(char) || unicode.IsDigit(char)
+}
+
+func is_token_end(char rune) bool {
+	return char == ',' ||
+		char == '}' ||
+		char == ']' ||
+		char == ' ' ||
+		char == '\n' ||
+		char == '\t' ||
+		char == '\r'
+}
+
+func (n *node) value() interface{} {
+	if n == nil {
+		return nil
+	}
+
+	switch n.kind {
+	case kind_object:
+		result := make(map[string]interface{}, len(n.keys))
+		for _, key := range n.keys {
+			result[key] = n.fields[key].value()
+		}
+		return result
+	case kind_array:
+		result := make([]interface{}, 0, len(n.items))
+		for _, item := range n.items {
+			result = append(result, item.value())
+		}
+		return result
+	case kind_string:
+		return n.text.String()
+	case kind_number:
+		return parse_number(n.text.String())
+	default:
+		return parse_literal(n.text.String(), n.literal_variants)
+	}
+}
+
+// parse_number reads as much of a (possibly unfinished) number as it can.
+// Integers come back as int, everything else as float64.
+func parse_number(numeric_string string) interface{} {
+	for len(numeric_string) > 0 {
+		if !strings.ContainsAny(numeric_string, ".eE") {
+			if result, err := strconv.ParseInt(numeric_string, 10, 0); err == nil {
+				return int(result)
+			}
+		}
+		if result, err := strconv.ParseFloat(numeric_string, 64); err == nil {
+			if math.IsInf(result, 0) {
+				return nil
+			}
+			return result
+		}
+		numeric_string = numeric_string[:len(numeric_string)-1]
+	}
+
+	return 0
+}
+
+// parse_literal reads an unfinished or finished true, false or null. With
+// variants it also accepts other spellings, like Python's True and None, and
+// turns NaN, Infinity and undefined into null.
+func parse_literal(literal string, variants bool) interface{} {
+	if variants {
+		literal = strings.ToLower(literal)
+	}
+
+	switch {
+	case strings.HasPrefix(literal, "t"):
+		return true
+	case strings.HasPrefix(literal, "f"):
+		return false
+	default:
+		return nil
+	}
+}
+
+func (n *node) encode(buffer *bytes.Buffer) {
+	if n == nil {
+		buffer.WriteString("null")
+		return
+	}
+	if n.encoded != nil {
+		buffer.Write(n.encoded)
+		return
+	}
+
+	start := buffer.Len()
+	switch n.kind {
+	case kind_object:
+		buffer.WriteByte('{')
+		for i, key := range n.keys {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			encode_string(buffer, key)
+			buffer.WriteByte(':')
+			n.fields[key].encode(buffer)
+		}
+		buffer.WriteByte('}')
+	case kind_array:
+		buffer.WriteByte('[')
+		for i, item := range n.items {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			item.encode(buffer)
+		}
+		buffer.WriteByte(']')
+	case kind_string:
+		encode_string(buffer, n.text.String())
+	default:
+		encoded, err := json.Marshal(n.value())
+		if err != nil {
+			encoded = []byte("null")
+		}
+		buffer.Write(encoded)
+	}
+
+	if n.complete {
+		n.encoded = append([]byte(nil), buffer.Bytes()[start:]...)
+		// The children are only ever encoded through this node from now on.
+		for _, child := range n.fields {
+			if child != nil {
+				child.encoded = nil
+			}
+		}
+		for _, child := range n.items {
+			child.encoded = nil
+		}
+	}
+}
+
+func encode_string(buffer *bytes.Buffer, s string) {
+	encoded, _ := json.Marshal(s)
+	buffer.Write(encoded)
+}
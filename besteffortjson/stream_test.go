@@ -0,0 +1,144 @@
+package besteffortjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStreamParser_matches_one_shot_parse(t *testing.T) {
+	inputs := []string{
+		`{ "fact": "something", "keywords": "pizza and such`,
+		`{ "fact": [ "one", "two"], "results": [ { "name": "john", "country": "usa" } ] }`,
+		"Hello, this is my answer.\n\n```json\n{\n\t\"fact\": [\"one\", \"two\"],\n\t\"n\": -12.5e2\n}\n```\nIs that the answer you wanted?",
+		`{"greeting": "héllo wörld ✓", "escaped": "a \"quoted\" word\n", "empty": [], "nested": {"deep": [1, [2, [3]]]}}`,
+		`{"literals": [true, false, null], "trailing": [1, 2, 3,], "partial": [tr`,
+	}
+
+	for _, input := range inputs {
+		expected := Best_effort_json_parse(input)
+
+		for _, chunk_size := range []int{1, 2, 3, 7} {
+			t.Run(fmt.Sprintf("%d byte chunks of %.20q", chunk_size, input), func(t *testing.T) {
+				parser := NewStreamParser()
+				for start := 0; start < len(input); start += chunk_size {
+					end := min(start+chunk_size, len(input))
+					parser.Write(input[start:end])
+
+					snapshot := parser.Snapshot()
+					if !json.Valid([]byte(snapshot)) {
+						t.Fatalf("Snapshot after %d bytes is not valid JSON: %s", end, snapshot)
+					}
+				}
+
+				if result := parser.Snapshot(); result != expected {
+					t.Errorf("Expected %s, got %s", expected, result)
+				}
+			})
+		}
+	}
+}
+
+func TestStreamParser_snapshots_grow(t *testing.T) {
+	parser := NewStreamParser()
+	steps := []struct {
+		chunk    string
+		expected string
+	}{
+		{`Sure!` + "\n", `null`},
+		{`{"results": [`, `{"results":[]}`},
+		{`{"name": "Ad`, `{"results":[{"name":"Ad"}]}`},
+		{`a", "age": 3`, `{"results":[{"name":"Ada","age":3}]}`},
+		{`6}, {"na`, `{"results":[{"name":"Ada","age":36},{}]}`},
+		{`me": "Grace"}]}` + "\n```", `{"results":[{"name":"Ada","age":36},{"name":"Grace"}]}`},
+		{"\nAnything else? {\"ignored\": true}", `{"results":[{"name":"Ada","age":36},{"name":"Grace"}]}`},
+	}
+
+	for _, step := range steps {
+		parser.Write(step.chunk)
+		if snapshot := parser.Snapshot(); snapshot != step.expected {
+			t.Fatalf("After %q expected %s, got %s", step.chunk, step.expected, snapshot)
+		}
+	}
+}
+
+// streamed_response builds a results document of roughly the given number of
+// tokens, split into token sized chunks like a model would stream it.
+func streamed_response(tokens int) []string {
+	chunks := []string{"{", `"results"`, ": ["}
+	for i := 0; len(chunks) < tokens; i++ {
+		if i > 0 {
+			chunks = append(chunks, ", ")
+		}
+		chunks = append(chunks,
+			`{"`, "title", `": "`, "Paper", " number", fmt.Sprintf(" %d", i), `", "`,
+			"year", `": `, fmt.Sprintf("%d", 1900+i%120), `, "`, "tags", `": ["`, "science", `", "`, "history", `"]}`,
+		)
+	}
+	return append(chunks, "]}")
+}
+
+// BenchmarkStreamParser compares feeding a response to a StreamParser with
+// re-parsing the whole accumulated response on every token. Writing costs the
+// same per token whatever the response length, taking a snapshot costs a copy
+// of the document so far, and re-parsing grows with the square of the length.
+func BenchmarkStreamParser(b *testing.B) {
+	for _, tokens := range []int{1000, 2000, 4000} {
+		chunks := streamed_response(tokens)
+
+		b.Run(fmt.Sprintf("write/%d_tokens", tokens), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parser := NewStreamParser()
+				for _, chunk := range chunks {
+					parser.Write(chunk)
+				}
+				parser.Snapshot()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(chunks)), "ns/token")
+		})
+
+		b.Run(fmt.Sprintf("write_and_snapshot/%d_tokens", tokens), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parser := NewStreamParser()
+				for _, chunk := range chunks {
+					parser.Write(chunk)
+					parser.Snapshot()
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(chunks)), "ns/token")
+		})
+
+		b.Run(fmt.Sprintf("reparse/%d_tokens", tokens), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var total strings.Builder
+				for _, chunk := range chunks {
+					total.WriteString(chunk)
+					Best_effort_json_parse(total.String())
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(chunks)), "ns/token")
+		})
+	}
+}
+
+func TestStreamParser_escape_split_across_chunks(t *testing.T) {
+	parser := NewStreamParser()
+	steps := []struct {
+		chunk    string
+		expected string
+	}{
+		{`{"text": "smile \u`, `{"text":"smile "}`},
+		{`d83d`, `{"text":"smile "}`},
+		{`\ude`, `{"text":"smile "}`},
+		{`00 \u00`, `{"text":"smile 😀 "}`},
+		{`e9"}`, `{"text":"smile 😀 é"}`},
+	}
+
+	for _, step := range steps {
+		parser.Write(step.chunk)
+		if snapshot := parser.Snapshot(); snapshot != step.expected {
+			t.Fatalf("After %q expected %s, got %s", step.chunk, step.expected, snapshot)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"sort"
-	"strconv"
 	"strings"
 
 	"github.com/farant/gpt-statemachine/prompt"
+	"github.com/farant/gpt-statemachine/statemachine"
 	"github.com/joho/godotenv"
 	"github.com/sashabaranov/go-openai"
 )
@@ -18,78 +21,235 @@ import (
 // DONE: Make unicode characters work ok
 // TODO: Make it work with arrays of ints?
 
-func runTimelineEvents(client *openai.Client, subject string) {
-	type Event struct {
-		YearPublished                string   `json:"year_published"`
-		FullNameOfAuthor             string   `json:"full_name_of_author"`
-		Title                        string   `json:"title"`
-		Description                  string   `json:"description"`
-		CounterIntuitivePropositions []string `json:"counter_intuitive_propositions"`
+type Event struct {
+	YearPublished                int      `json:"year_published" example:"1905"`
+	FullNameOfAuthor             string   `json:"full_name_of_author"`
+	Title                        string   `json:"title"`
+	Description                  string   `json:"description" desc:"one or two sentences on why it matters"`
+	CounterIntuitivePropositions []string `json:"counter_intuitive_propositions" max:"3"`
+}
+
+type Critique struct {
+	Verdict  string   `json:"verdict" enum:"approve,revise"`
+	Problems []string `json:"problems"`
+}
+
+// TimelineData is shared by every state of the timeline workflow.
+type TimelineData struct {
+	Subject  string
+	Events   []Event
+	Critique Critique
+	Rounds   int
+}
+
+const max_refinement_rounds = 2
+
+func print_events(events []Event) {
+	// Combine counterintuitive propositions of duplicate papers
+	combinedEvents := make(map[string]Event)
+	for _, event := range events {
+		key := event.Title + event.FullNameOfAuthor
+		if val, ok := combinedEvents[key]; ok {
+			val.CounterIntuitivePropositions = append(val.CounterIntuitivePropositions, event.CounterIntuitivePropositions...)
+			combinedEvents[key] = val
+		} else {
+			combinedEvents[key] = event
+		}
+	}
+	// Convert the map back to slice
+	sortedEvents := make([]Event, 0, len(combinedEvents))
+	for _, event := range combinedEvents {
+		sortedEvents = append(sortedEvents, event)
 	}
 
-	type Arguments struct {
-		Subject string
+	// Sort the slice by year
+	sort.Slice(sortedEvents, func(i, j int) bool {
+		return sortedEvents[i].YearPublished < sortedEvents[j].YearPublished
+	})
+
+	// Print the combined events
+	for _, event := range sortedEvents {
+		fmt.Printf("\n- %5d: \"%s\" by %s\n  %s\n", event.YearPublished, event.Title, event.FullNameOfAuthor, event.Description)
+		for _, proposition := range event.CounterIntuitivePropositions {
+			fmt.Printf("  * %s\n", proposition)
+		}
 	}
+}
 
-	timeline_events := prompt.Prompt[Event, Arguments]{
+func format_events(events []Event) string {
+	var builder strings.Builder
+	for _, event := range events {
+		fmt.Fprintf(&builder, "- %d: \"%s\" by %s. %s\n", event.YearPublished, event.Title, event.FullNameOfAuthor, event.Description)
+	}
+	return builder.String()
+}
+
+func print_progress(progress []Event, raw_string string) {
+	fmt.Print("\033[H\033[2J")
+	print_events(progress)
+}
+
+func timelineMachine() statemachine.Machine[TimelineData] {
+	type TimelineArguments struct {
+		Subject string `prompt:"untrusted"`
+	}
+
+	type CritiqueArguments struct {
+		Subject  string `prompt:"untrusted"`
+		Timeline string
+	}
+
+	type RefineArguments struct {
+		Subject  string `prompt:"untrusted"`
+		Timeline string
+		Problems []string
+	}
+
+	timeline_events := prompt.Prompt[Event, TimelineArguments]{
 		Prompt: `
 		Please generate a timeline of 10 important scientific papers related to {{Subject}}. 
 		`,
-		Arguments:        Arguments{},
+		Arguments:        TimelineArguments{},
 		Json_output:      Event{},
 		Array_of_results: true,
-	}
+		Examples: []prompt.Example[Event, TimelineArguments]{{
+			Input: TimelineArguments{Subject: "special relativity"},
+			Output: Event{
+				YearPublished:    1905,
+				FullNameOfAuthor: "Albert Einstein",
+				Title:            "On the Electrodynamics of Moving Bodies",
+				Description:      "Showed that the speed of light is the same for every observer, so time and space depend on motion.",
+				CounterIntuitivePropositions: []string{
+					"Moving clocks run slower",
+					"Two events can be simultaneous for one observer and not for another",
+				},
+			},
+		}},
+		ModelParameters: prompt.ModelParameters{
+			Model: openai.GPT3Dot5Turbo,
+		},
+	}.MustCompile()
 
-	print_events := func(events []Event) {
-		// Combine counterintuitive propositions of duplicate papers
-		combinedEvents := make(map[string]Event)
-		for _, event := range events {
-			key := event.Title + event.FullNameOfAuthor
-			if val, ok := combinedEvents[key]; ok {
-				val.CounterIntuitivePropositions = append(val.CounterIntuitivePropositions, event.CounterIntuitivePropositions...)
-				combinedEvents[key] = val
-			} else {
-				combinedEvents[key] = event
-			}
-		}
-		// Convert the map back to slice
-		sortedEvents := make([]Event, 0, len(combinedEvents))
-		for _, event := range combinedEvents {
-			sortedEvents = append(sortedEvents, event)
-		}
+	critique := prompt.Prompt[Critique, CritiqueArguments]{
+		Prompt: `
+		Here is a timeline of important scientific papers related to {{Subject}}:
 
-		// Sort the slice by year
-		sort.Slice(sortedEvents, func(i, j int) bool {
-			yearI, _ := strconv.Atoi(sortedEvents[i].YearPublished)
-			yearJ, _ := strconv.Atoi(sortedEvents[j].YearPublished)
-			return yearI < yearJ
-		})
-
-		// Print the combined events
-		for _, event := range sortedEvents {
-			fmt.Printf("\n- %5s: \"%s\" by %s\n  %s\n", event.YearPublished, event.Title, event.FullNameOfAuthor, event.Description)
-			for _, proposition := range event.CounterIntuitivePropositions {
-				fmt.Printf("  * %s\n", proposition)
-			}
-		}
-	}
+		{{Timeline}}
 
-	result := timeline_events.Run(client, prompt.RunOptions[Event, Arguments]{
-		Arguments: Arguments{
-			Subject: subject,
+		Check it for papers that don't exist, wrong authors or years, and important papers that are missing.
+		Answer with the verdict "approve" if the timeline is accurate, or "revise" and a list of the problems.
+		`,
+		Arguments:   CritiqueArguments{},
+		Json_output: Critique{},
+		ModelParameters: prompt.ModelParameters{
+			Model:       openai.GPT4,
+			Temperature: prompt.Float32(0),
 		},
-		On_json_array_progress: func(progress []Event, raw_string string) {
-			fmt.Print("\033[H\033[2J")
-			print_events(progress)
+	}.MustCompile()
+
+	refine := prompt.Prompt[Event, RefineArguments]{
+		Prompt: `
+		Here is a timeline of important scientific papers related to {{.Subject}}:
+
+		{{.Timeline}}
+
+		A reviewer found these problems with it:
+
+		{{bullets .Problems}}
+
+		Please generate a corrected timeline of 10 papers that fixes these problems.
+		`,
+		Syntax:           prompt.Syntax_text_template,
+		Arguments:        RefineArguments{},
+		Json_output:      Event{},
+		Array_of_results: true,
+		ModelParameters: prompt.ModelParameters{
+			Model: openai.GPT4,
 		},
-	})
+	}.MustCompile()
+
+	return statemachine.Machine[TimelineData]{
+		Start: "timeline",
+		States: map[string]statemachine.State[TimelineData]{
+			"timeline": statemachine.Prompt_state(
+				timeline_events,
+				func(data *TimelineData) prompt.RunOptions[Event, TimelineArguments] {
+					return prompt.RunOptions[Event, TimelineArguments]{
+						Arguments:              TimelineArguments{Subject: data.Subject},
+						On_json_array_progress: print_progress,
+					}
+				},
+				func(data *TimelineData, result prompt.PromptResult[Event]) string {
+					data.Events = result.Parsed_results_array
+					return "critique"
+				},
+			),
+			"critique": statemachine.Prompt_state(
+				critique,
+				func(data *TimelineData) prompt.RunOptions[Critique, CritiqueArguments] {
+					return prompt.RunOptions[Critique, CritiqueArguments]{
+						Arguments: CritiqueArguments{
+							Subject:  data.Subject,
+							Timeline: format_events(data.Events),
+						},
+					}
+				},
+				func(data *TimelineData, result prompt.PromptResult[Critique]) string {
+					data.Critique = result.Parsed_result
+					if data.Critique.Verdict != "revise" || data.Rounds >= max_refinement_rounds {
+						return statemachine.Done
+					}
+					return "refine"
+				},
+			),
+			"refine": statemachine.Prompt_state(
+				refine,
+				func(data *TimelineData) prompt.RunOptions[Event, RefineArguments] {
+					return prompt.RunOptions[Event, RefineArguments]{
+						Arguments: RefineArguments{
+							Subject:  data.Subject,
+							Timeline: format_events(data.Events),
+							Problems: data.Critique.Problems,
+						},
+						On_json_array_progress: print_progress,
+					}
+				},
+				func(data *TimelineData, result prompt.PromptResult[Event]) string {
+					data.Events = result.Parsed_results_array
+					data.Rounds++
+					return "critique"
+				},
+			),
+		},
+	}
+}
+
+func runTimelineEvents(ctx context.Context, client *openai.Client, subject string) {
+	data := TimelineData{Subject: subject}
+
+	trace, err := timelineMachine().RunContext(ctx, prompt.OpenAIProvider{Client: client}, &data)
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Interrupted, showing partial results.")
+	} else if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	for _, step := range trace {
+		fmt.Printf("\n\nSTATE %s\n\nPROMPT:\n\n", step.State)
+		if result, ok := statemachine.Result_of[Event](step); ok {
+			fmt.Println(result.Prompt_text)
+			fmt.Printf("\n\nRESPONSE:\n\n")
+			fmt.Println(result.Parsed_results_json)
+		} else if result, ok := statemachine.Result_of[Critique](step); ok {
+			fmt.Println(result.Prompt_text)
+			fmt.Printf("\n\nRESPONSE:\n\n")
+			fmt.Println(result.Parsed_results_json)
+		}
+	}
 
-	fmt.Printf("PROMPT:\n\n")
-	fmt.Println(result.Prompt_text)
-	fmt.Printf("\n\nRESPONSE:\n\n")
-	fmt.Println(result.Parsed_results_json)
 	fmt.Printf("\n\nPARSED:\n\n")
-	print_events(result.Parsed_results_array)
+	print_events(data.Events)
 }
 
 func main() {
@@ -110,5 +270,8 @@ func main() {
 
 	client := openai.NewClient(api_key)
 
-	runTimelineEvents(client, combined_args)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	runTimelineEvents(ctx, client, combined_args)
 }
@@ -0,0 +1,305 @@
+package prompt
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// CompileError lists what Compile found wrong with the templates of a prompt.
+type CompileError struct {
+	// Err is set when a template doesn't parse.
+	Err error
+	// Unknown are the placeholders that don't match an Input field.
+	Unknown []string
+	// Unused are the Input fields no placeholder refers to. A prompt whose
+	// only problem is unused fields still renders fine.
+	Unused []string
+}
+
+func (e *CompileError) Error() string {
+	var problems []string
+	if e.Err != nil {
+		problems = append(problems, e.Err.Error())
+	}
+	if len(e.Unknown) > 0 {
+		problems = append(problems, "unknown placeholders "+strings.Join(e.Unknown, ", "))
+	}
+	if len(e.Unused) > 0 {
+		problems = append(problems, "unused arguments "+strings.Join(e.Unused, ", "))
+	}
+	return "prompt: compile error: " + strings.Join(problems, "; ")
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// compiled_templates are the parsed Prompt and System texts, by text, so a
+// compiled prompt whose texts are changed afterwards is parsed again.
+type compiled_templates struct {
+	templates map[string]*template.Template
+}
+
+// Compile parses the Prompt and System texts once and checks every
+// placeholder against the fields of the Input type. The returned prompt
+// reuses the parsed templates on every run.
+//
+// The error is a *CompileError. If it only lists Unused fields the returned
+// prompt is compiled and can be used anyway; otherwise it is p unchanged.
+func (p Prompt[Output, Input]) Compile() (Prompt[Output, Input], error) {
+	input := reflect.TypeOf((*Input)(nil)).Elem()
+	checker := placeholder_checker{root: input, used: map[string]bool{}, partials: map[string]bool{}}
+	compiled := &compiled_templates{templates: map[string]*template.Template{}}
+
+	for _, text := range []string{p.Prompt, p.System} {
+		if p.Syntax == Syntax_text_template {
+			tmpl, err := p.parse_template(text)
+			if err != nil {
+				return p, &CompileError{Err: err}
+			}
+			compiled.templates[text] = tmpl
+			checker.tmpl = tmpl
+			if tmpl.Tree != nil {
+				checker.walk(tmpl.Tree.Root, input)
+			}
+		} else {
+			for _, match := range placeholder_pattern.FindAllStringSubmatch(text, -1) {
+				checker.placeholder(match[1])
+			}
+		}
+	}
+
+	compile_error := &CompileError{Unknown: checker.unknown}
+	for _, name := range argument_names(input) {
+		if !checker.used[name] {
+			compile_error.Unused = append(compile_error.Unused, name)
+		}
+	}
+
+	if len(compile_error.Unknown) > 0 {
+		return p, compile_error
+	}
+	p.compiled = compiled
+	if len(compile_error.Unused) > 0 {
+		return p, compile_error
+	}
+	return p, nil
+}
+
+// MustCompile is Compile for prompts defined at startup. It panics if
+// Compile reports any problem, unused fields included.
+func (p Prompt[Output, Input]) MustCompile() Prompt[Output, Input] {
+	compiled, err := p.Compile()
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// argument_names are the names placeholders can use at the top level: the
+// exported fields of a struct, or nothing for maps and other types.
+func argument_names(t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			names = append(names, t.Field(i).Name)
+		}
+	}
+	return names
+}
+
+// placeholder_checker follows the field references of a text/template
+// through the Input type. A nil type is one it can't know, like the result of
+// a function or an interface value, and isn't checked.
+type placeholder_checker struct {
+	root     reflect.Type
+	tmpl     *template.Template
+	used     map[string]bool
+	unknown  []string
+	partials map[string]bool
+}
+
+// field returns the type of the field or method name of t, recording it as
+// unknown if there is none. top is set for the fields of the Input itself.
+func (c *placeholder_checker) field(t reflect.Type, name string, top bool) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	if top {
+		c.used[name] = true
+	}
+
+	if method, ok := t.MethodByName(name); ok && method.IsExported() {
+		return returned_type(method.Type)
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if method, ok := reflect.PointerTo(t).MethodByName(name); ok && method.IsExported() {
+		return returned_type(method.Type)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if field, ok := t.FieldByName(name); ok && field.IsExported() {
+			return field.Type
+		}
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Interface:
+		return nil
+	}
+
+	placeholder := name
+	if !top {
+		placeholder = t.String() + "." + name
+	}
+	c.add_unknown(placeholder)
+	return nil
+}
+
+// placeholder checks a placeholder of Syntax_placeholders, which can only
+// name what StructToMap lists: the top-level fields of a struct, not its
+// methods or promoted fields, or any key of a map.
+func (c *placeholder_checker) placeholder(name string) {
+	c.used[name] = true
+	t := c.root
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Interface:
+		return
+	case reflect.Struct:
+		if field, ok := t.FieldByName(name); ok && field.IsExported() && len(field.Index) == 1 {
+			return
+		}
+	}
+	c.add_unknown(name)
+}
+
+func (c *placeholder_checker) add_unknown(placeholder string) {
+	for _, unknown := range c.unknown {
+		if unknown == placeholder {
+			return
+		}
+	}
+	c.unknown = append(c.unknown, placeholder)
+	sort.Strings(c.unknown)
+}
+
+func returned_type(method reflect.Type) reflect.Type {
+	if method.NumOut() == 0 {
+		return nil
+	}
+	return method.Out(0)
+}
+
+// fields follows a chain of field names from t.
+func (c *placeholder_checker) fields(t reflect.Type, names []string, top bool) reflect.Type {
+	for i, name := range names {
+		t = c.field(t, name, top && i == 0)
+	}
+	return t
+}
+
+// element is the type range sets dot to for a t.
+func element(t reflect.Type) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return t.Elem()
+	}
+	return nil
+}
+
+func (c *placeholder_checker) walk(node parse.Node, dot reflect.Type) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			c.walk(child, dot)
+		}
+	case *parse.ActionNode:
+		c.pipe(node.Pipe, dot)
+	case *parse.IfNode:
+		c.pipe(node.Pipe, dot)
+		c.walk(node.List, dot)
+		c.walk(node.ElseList, dot)
+	case *parse.RangeNode:
+		c.walk(node.List, element(c.pipe(node.Pipe, dot)))
+		c.walk(node.ElseList, dot)
+	case *parse.WithNode:
+		c.walk(node.List, c.pipe(node.Pipe, dot))
+		c.walk(node.ElseList, dot)
+	case *parse.TemplateNode:
+		var partial_dot reflect.Type
+		if node.Pipe != nil {
+			partial_dot = c.pipe(node.Pipe, dot)
+		}
+		// Each partial is checked once per type of dot.
+		key := fmt.Sprintf("%s %v", node.Name, partial_dot)
+		if partial := c.tmpl.Lookup(node.Name); partial != nil && partial.Tree != nil && !c.partials[key] {
+			c.partials[key] = true
+			c.walk(partial.Tree.Root, partial_dot)
+		}
+	}
+}
+
+// pipe checks the fields a pipeline refers to and returns the type of its
+// result, if it is a plain field reference.
+func (c *placeholder_checker) pipe(pipe *parse.PipeNode, dot reflect.Type) reflect.Type {
+	if pipe == nil {
+		return nil
+	}
+
+	var result reflect.Type
+	for i, command := range pipe.Cmds {
+		for _, arg := range command.Args {
+			result = c.arg(arg, dot)
+		}
+		if len(command.Args) != 1 || i > 0 {
+			result = nil
+		}
+	}
+	return result
+}
+
+func (c *placeholder_checker) arg(node parse.Node, dot reflect.Type) reflect.Type {
+	switch node := node.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return c.fields(dot, node.Ident, dot == c.root)
+	case *parse.VariableNode:
+		if node.Ident[0] == "$" {
+			return c.fields(c.root, node.Ident[1:], true)
+		}
+	case *parse.ChainNode:
+		if pipe, ok := node.Node.(*parse.PipeNode); ok {
+			return c.fields(c.pipe(pipe, dot), node.Field, false)
+		}
+		return c.fields(c.arg(node.Node, dot), node.Field, false)
+	case *parse.PipeNode:
+		return c.pipe(node, dot)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package prompt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrProgressRequiresArray is returned when On_json_array_progress is set on a
+// prompt that doesn't ask for an array of results.
+var ErrProgressRequiresArray = errors.New("prompt: On_json_array_progress requires Array_of_results to be true")
+
+// ErrProgressRequiresObject is returned when On_json_object_progress is set on
+// a prompt that asks for an array of results.
+var ErrProgressRequiresObject = errors.New("prompt: On_json_object_progress requires Array_of_results to be false")
+
+// ErrNoJson is wrapped in a ParseError when the response contains no JSON.
+var ErrNoJson = errors.New("no JSON found in response")
+
+// TransportError is returned when the provider fails to open or read the
+// completion stream.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("prompt: transport error: %v", e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// TemplateError is returned when the prompt text can't be rendered, for
+// example because a placeholder has no matching argument. Placeholder is
+// empty when text/template doesn't say where the error is.
+type TemplateError struct {
+	Placeholder string
+	Err         error
+}
+
+func (e *TemplateError) Error() string {
+	if e.Placeholder == "" {
+		return fmt.Sprintf("prompt: template error: %v", e.Err)
+	}
+	return fmt.Sprintf("prompt: template error at {{%s}}: %v", e.Placeholder, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is returned when no usable JSON could be recovered from the
+// response.
+type ParseError struct {
+	Response string
+	Err      error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("prompt: parse error: %v", e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// SchemaError is returned when the response is valid JSON but doesn't match
+// the Output type.
+type SchemaError struct {
+	Json string
+	Err  error
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("prompt: response doesn't match output schema: %v", e.Err)
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// CallbackError is returned when a progress callback panics. The stream is
+// still read to the end, but the callback isn't called again.
+type CallbackError struct {
+	Panic any
+	Stack []byte
+}
+
+func (e *CallbackError) Error() string {
+	return fmt.Sprintf("prompt: progress callback panicked: %v", e.Panic)
+}
@@ -0,0 +1,120 @@
+package prompt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/farant/gpt-statemachine/besteffortjson"
+)
+
+// Example is a request with the answer the model should give to it, shown to
+// the model so it imitates real answers rather than the schema's
+// placeholders.
+type Example[Output any, Input any] struct {
+	// Input are the arguments the prompt text is rendered with.
+	Input  Input
+	Output Output
+	// Results is the answer of Array_of_results prompts. When it is empty
+	// Output is the only result.
+	Results []Output
+}
+
+// ExamplesPlacement decides how the Examples of a prompt are shown.
+type ExamplesPlacement int
+
+const (
+	// Examples_inline lists the examples after the format instructions.
+	Examples_inline ExamplesPlacement = iota
+	// Examples_as_turns sends each example as an earlier user message and
+	// assistant reply, before the conversation.
+	Examples_as_turns
+)
+
+// example_response is the JSON the model should answer an example with, in
+// the same shape and with the same key naming as the answers it is decoded
+// from.
+func (p Prompt[Output, Input]) example_response(example Example[Output, Input]) (string, error) {
+	var response interface{} = example.Output
+	switch {
+	case p.Array_of_results:
+		results := example.Results
+		if len(results) == 0 {
+			results = []Output{example.Output}
+		}
+		response = map[string]interface{}{"results": results}
+	case p.wraps_result():
+		response = map[string]interface{}{"result": example.Output}
+	}
+
+	encoded, err := besteffortjson.Marshal(response, p.key_naming())
+	if err != nil {
+		return "", err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, encoded, "", "\t"); err != nil {
+		return "", err
+	}
+	return indented.String(), nil
+}
+
+// example_turns are the Examples as user messages and assistant replies.
+func (p Prompt[Output, Input]) example_turns() ([]ChatMessage, error) {
+	if p.Example_placement != Examples_as_turns {
+		return nil, nil
+	}
+
+	var turns []ChatMessage
+	for i, example := range p.Examples {
+		request, err := p.render(p.Prompt, example.Input)
+		if err != nil {
+			return nil, fmt.Errorf("prompt: example %d: %w", i+1, err)
+		}
+		response, err := p.example_response(example)
+		if err != nil {
+			return nil, fmt.Errorf("prompt: example %d: %w", i+1, err)
+		}
+		turns = append(turns,
+			ChatMessage{Role: Role_user, Content: request},
+			ChatMessage{Role: Role_assistant, Content: response},
+		)
+	}
+	return turns, nil
+}
+
+// inline_examples lists the Examples for the format instructions.
+func (p Prompt[Output, Input]) inline_examples() (string, error) {
+	if p.Example_placement != Examples_inline || len(p.Examples) == 0 {
+		return "", nil
+	}
+
+	var output strings.Builder
+	output.WriteString("Here are examples of good answers:")
+	for i, example := range p.Examples {
+		request, err := p.render(p.Prompt, example.Input)
+		if err != nil {
+			return "", fmt.Errorf("prompt: example %d: %w", i+1, err)
+		}
+		response, err := p.example_response(example)
+		if err != nil {
+			return "", fmt.Errorf("prompt: example %d: %w", i+1, err)
+		}
+		fmt.Fprintf(&output, "\n\nExample %d:\n%s\n\nAnswer:\n%s", i+1, strings.TrimSpace(request), response)
+	}
+	return output.String(), nil
+}
+
+// format_section is the format instructions followed by the inline examples.
+func (p Prompt[Output, Input]) format_section() (string, error) {
+	examples, err := p.inline_examples()
+	if err != nil {
+		return "", err
+	}
+
+	instructions := p.Generate_format_instructions()
+	if examples != "" {
+		instructions += "\n\n" + examples
+	}
+	return instructions, nil
+}
@@ -0,0 +1,91 @@
+package prompt
+
+import (
+	"strconv"
+
+	"github.com/farant/gpt-statemachine/besteffortjson"
+)
+
+// item_tracker tells when elements of the top level results array start and
+// end, going by the completeness the stream parser records for them. Every
+// check is a single pointer lookup, so it is cheap to run on every delta.
+type item_tracker struct {
+	// objects is set when the items are objects, so a bare array of
+	// anything else, like a citation in the prose before the answer, isn't
+	// taken for the results.
+	objects   bool
+	started   int
+	completed int
+}
+
+type item_event struct {
+	index     int
+	completed bool
+}
+
+// feed returns the items that started or completed since the last call, in
+// order. Items complete one at a time, so an item only counts as started once
+// the one before it is finished.
+func (t *item_tracker) feed(parser *besteffortjson.StreamParser) []item_event {
+	var events []item_event
+	document, _ := parser.Document()
+	if document.Is_array("") && t.objects && !document.Is_object("/0") {
+		return events
+	}
+
+	for {
+		if t.completed < t.started {
+			if complete, _ := document.Is_complete(results_item_pointer(document, t.completed)); !complete {
+				return events
+			}
+			events = append(events, item_event{index: t.completed, completed: true})
+			t.completed++
+			continue
+		}
+
+		if _, found := document.Is_complete(results_item_pointer(document, t.started)); !found {
+			return events
+		}
+		events = append(events, item_event{index: t.started})
+		t.started++
+	}
+}
+
+// results_item_pointer points to an item of the results, which are the
+// document itself when the model answered with a bare array.
+func results_item_pointer(document besteffortjson.Document, index int) string {
+	if document.Is_array("") {
+		return "/" + strconv.Itoa(index)
+	}
+	return "/results/" + strconv.Itoa(index)
+}
+
+// item_cache holds the decoded items of the results array. Items are decoded
+// once, when they complete, so each delta only decodes the item still open
+// and progress costs the same at the end of a long response as at its start.
+type item_cache[Output any] struct {
+	items     []Output
+	completed int
+}
+
+// update decodes the items the tracker found complete since the last call
+// and the open one, and returns the results so far. The open item is decoded
+// again into the same place on the next call.
+func (c *item_cache[Output]) update(decoder besteffortjson.Decoder, document besteffortjson.Document, tracker item_tracker) []Output {
+	c.items = c.items[:c.completed]
+	for ; c.completed < tracker.completed; c.completed++ {
+		c.items = append(c.items, decode_item[Output](decoder, document, c.completed))
+	}
+	if tracker.completed < tracker.started {
+		c.items = append(c.items, decode_item[Output](decoder, document, tracker.completed))
+	}
+	return c.items[:len(c.items):len(c.items)]
+}
+
+// decode_item decodes an item of the results. Values that don't fit are
+// left out, as in the final decode.
+func decode_item[Output any](decoder besteffortjson.Decoder, document besteffortjson.Document, index int) Output {
+	var item Output
+	decoder.Decode_pointer(document, results_item_pointer(document, index), &item)
+	return item
+}
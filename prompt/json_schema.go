@@ -0,0 +1,297 @@
+package prompt
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"github.com/farant/gpt-statemachine/besteffortjson"
+)
+
+// Json_schema_draft is the $schema of the root of a Json_schema.
+const Json_schema_draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Json_schema is a JSON Schema (draft 2020-12) that encodes with
+// encoding/json. Only the keywords Type_to_json_schema produces are
+// supported.
+type Json_schema struct {
+	Schema      string        `json:"$schema,omitempty"`
+	Ref         string        `json:"$ref,omitempty"`
+	Type        interface{}   `json:"type,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Format      string        `json:"format,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Examples    []interface{} `json:"examples,omitempty"`
+
+	Properties map[string]*Json_schema `json:"properties,omitempty"`
+	Required   []string                `json:"required,omitempty"`
+	// Additional_properties is false for structs, and the schema of the
+	// values for maps.
+	Additional_properties interface{}  `json:"additionalProperties,omitempty"`
+	Items                 *Json_schema `json:"items,omitempty"`
+
+	Minimum          *float64 `json:"minimum,omitempty"`
+	Maximum          *float64 `json:"maximum,omitempty"`
+	Min_length       *int     `json:"minLength,omitempty"`
+	Max_length       *int     `json:"maxLength,omitempty"`
+	Min_items        *int     `json:"minItems,omitempty"`
+	Max_items        *int     `json:"maxItems,omitempty"`
+	Content_encoding string   `json:"contentEncoding,omitempty"`
+
+	Any_of []*Json_schema `json:"anyOf,omitempty"`
+	// Defs holds the recursive structs, which refer to themselves with
+	// "#/$defs/Name".
+	Defs map[string]*Json_schema `json:"$defs,omitempty"`
+}
+
+// Type_to_json_schema describes the JSON encoding of t as a JSON Schema.
+// Fields without omitempty are required, pointers may be null and the desc,
+// example, enum, min, max and format tags of the fields become description,
+// examples, enum, bounds and format. Recursive structs are defined in $defs.
+// Fields without a json tag name are named with naming, nil meaning
+// besteffortjson.Verbatim like encoding/json.
+func Type_to_json_schema(t reflect.Type, naming besteffortjson.Key_naming) *Json_schema {
+	root := describe_type(t, naming)
+	builder := json_schema_builder{root: root}
+	return builder.document(builder.schema(root, field_hints{}, false))
+}
+
+// Output_json_schema is the JSON Schema of the response the prompt asks for:
+// an Output, or an object with a results array of them when
+// Array_of_results is set, or with the result when the Output isn't an object
+// by itself. It uses the same key naming as the prompt.
+func (p Prompt[Output, Input]) Output_json_schema() *Json_schema {
+	output := describe_type(p.output_type(), p.key_naming())
+	builder := json_schema_builder{root: output}
+	switch {
+	case p.Array_of_results:
+		builder.root = nil
+		return builder.document(builder.wrapper("results", &Json_schema{Type: "array", Items: builder.schema(output, field_hints{}, false)}))
+	case p.wraps_result():
+		builder.root = nil
+		return builder.document(builder.wrapper("result", builder.schema(output, field_hints{}, false)))
+	}
+	return builder.document(builder.schema(output, field_hints{}, false))
+}
+
+// json_schema_builder renders shapes as JSON Schemas, collecting the
+// definitions of recursive structs on the way.
+type json_schema_builder struct {
+	// root is the shape of the whole document, which recursive references
+	// to point to with "#" instead of a definition.
+	root  *type_shape
+	defs  map[string]*Json_schema
+	names map[reflect.Type]string
+}
+
+func (b *json_schema_builder) document(schema *Json_schema) *Json_schema {
+	schema.Schema = Json_schema_draft
+	schema.Defs = b.defs
+	return schema
+}
+
+func (b *json_schema_builder) wrapper(name string, value *Json_schema) *Json_schema {
+	return &Json_schema{
+		Type:                  "object",
+		Properties:            map[string]*Json_schema{name: value},
+		Required:              []string{name},
+		Additional_properties: false,
+	}
+}
+
+// ref defines the recursive struct target, if it isn't yet, and returns the
+// reference to it.
+func (b *json_schema_builder) ref(target *type_shape) string {
+	if b.root != nil && target.t == b.root.t {
+		return "#"
+	}
+	if name, ok := b.names[target.t]; ok {
+		return "#/$defs/" + name
+	}
+
+	if b.defs == nil {
+		b.defs = map[string]*Json_schema{}
+		b.names = map[reflect.Type]string{}
+	}
+	name := target.t.Name()
+	for i := 2; b.defs[name] != nil; i++ {
+		name = target.t.Name() + strconv.Itoa(i)
+	}
+	b.names[target.t] = name
+
+	// The definition is of the struct, the references say whether it may
+	// be null.
+	definition := *target
+	definition.nullable = false
+	b.defs[name] = &Json_schema{}
+	*b.defs[name] = *b.definition(&definition, field_hints{}, false)
+	return "#/$defs/" + name
+}
+
+// schema is the JSON Schema of a value of the shape, in a field with the
+// hints. quoted is set by the ",string" tag option.
+func (b *json_schema_builder) schema(s *type_shape, hints field_hints, quoted bool) *Json_schema {
+	target := s.cycle
+	if target == nil && s.recursive && s != b.root {
+		target = s
+	}
+	if target == nil {
+		return b.definition(s, hints, quoted)
+	}
+
+	ref := &Json_schema{Ref: b.ref(target)}
+	if s.nullable {
+		ref = &Json_schema{Any_of: []*Json_schema{ref, {Type: "null"}}}
+	}
+	ref.Description = hints.desc
+	return ref
+}
+
+// definition is the JSON Schema of a value of the shape itself, even if it
+// is recursive.
+func (b *json_schema_builder) definition(s *type_shape, hints field_hints, quoted bool) *Json_schema {
+	schema := &Json_schema{Description: hints.desc, Format: s.format}
+	if hints.format != "" {
+		schema.Format = hints.format
+	}
+
+	switch s.kind {
+	case shape_object:
+		schema.Type = "object"
+		schema.Properties = map[string]*Json_schema{}
+		for _, field := range s.fields {
+			schema.Properties[field.name] = b.schema(field.shape, field.hints, field.quoted)
+			if !field.optional {
+				schema.Required = append(schema.Required, field.name)
+			}
+		}
+		schema.Additional_properties = false
+	case shape_map:
+		schema.Type = "object"
+		schema.Additional_properties = b.schema(s.elem, field_hints{}, false)
+	case shape_array:
+		schema.Type = "array"
+		// The enum and format of a slice field are those of its elements.
+		schema.Format = ""
+		schema.Items = b.schema(s.elem, field_hints{enum: hints.enum, format: hints.format}, quoted)
+		schema.Min_items = parse_count(hints.min)
+		schema.Max_items = parse_count(hints.max)
+		if example, ok := s.example(hints.example); ok {
+			schema.Examples = []interface{}{example}
+		}
+	case shape_string:
+		schema.Type = "string"
+		if s.format == "base64" {
+			schema.Format = ""
+			schema.Content_encoding = "base64"
+		}
+		schema.Min_length = parse_count(hints.min)
+		schema.Max_length = parse_count(hints.max)
+	case shape_integer, shape_number:
+		schema.Type = "number"
+		if s.kind == shape_integer {
+			schema.Type = "integer"
+		}
+		schema.Minimum = parse_bound(hints.min)
+		schema.Maximum = parse_bound(hints.max)
+		if s.unsigned && schema.Minimum == nil {
+			schema.Minimum = parse_bound("0")
+		}
+		if quoted {
+			// ",string" fields are encoded as strings holding the number.
+			schema.Type = "string"
+			schema.Minimum, schema.Maximum = nil, nil
+		}
+	case shape_boolean:
+		schema.Type = "boolean"
+		if quoted {
+			schema.Type = "string"
+		}
+	}
+
+	if s.kind != shape_array {
+		for _, value := range hints.enum {
+			if enum_value, ok := s.scalar_value(value, quoted); ok {
+				schema.Enum = append(schema.Enum, enum_value)
+			}
+		}
+		if example, ok := s.scalar_value(hints.example, quoted); ok && hints.example != "" {
+			schema.Examples = []interface{}{example}
+		}
+	}
+
+	if s.nullable && schema.Type != nil {
+		schema.Type = []string{schema.Type.(string), "null"}
+		if schema.Enum != nil {
+			schema.Enum = append(schema.Enum, nil)
+		}
+	}
+	return schema
+}
+
+// scalar_value reads a tag value as a value of the shape.
+func (s *type_shape) scalar_value(text string, quoted bool) (interface{}, bool) {
+	if quoted {
+		return text, true
+	}
+
+	switch s.kind {
+	case shape_string:
+		return text, true
+	case shape_integer:
+		if value, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return value, true
+		}
+	case shape_number:
+		if value, err := strconv.ParseFloat(text, 64); err == nil {
+			return value, true
+		}
+	case shape_boolean:
+		if value, err := strconv.ParseBool(text); err == nil {
+			return value, true
+		}
+	default:
+		var value interface{}
+		if err := json.Unmarshal([]byte(text), &value); err == nil {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// example reads the example tag of a slice field, a comma separated list or
+// a JSON array.
+func (s *type_shape) example(text string) (interface{}, bool) {
+	if text == "" {
+		return nil, false
+	}
+
+	var items []interface{}
+	if err := json.Unmarshal([]byte(text), &items); err == nil {
+		return items, true
+	}
+	for _, item := range split_list(text) {
+		value, ok := s.elem.scalar_value(item, false)
+		if !ok {
+			return nil, false
+		}
+		items = append(items, value)
+	}
+	return items, true
+}
+
+func parse_bound(text string) *float64 {
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+func parse_count(text string) *int {
+	value, err := strconv.Atoi(text)
+	if err != nil || value < 0 {
+		return nil
+	}
+	return &value
+}
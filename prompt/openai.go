@@ -2,50 +2,85 @@ package prompt
 
 import (
 	"context"
-	"errors"
-	"fmt"
-	"io"
-	"os"
+	"math"
 
 	"github.com/sashabaranov/go-openai"
 )
 
-func run_prompt(prompt string, client *openai.Client, streaming_response chan<- string) string {
+// OpenAIProvider streams completions from the OpenAI chat API.
+type OpenAIProvider struct {
+	Client *openai.Client
+}
+
+func (o OpenAIProvider) Stream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	model := request.Model
+	if model == "" {
+		model = openai.GPT4
+	}
+
 	req := openai.ChatCompletionRequest{
-		Model: openai.GPT4,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: prompt,
-			},
-		},
-		Stream: true,
+		Model:     model,
+		Stream:    true,
+		MaxTokens: request.Max_tokens,
+		Stop:      request.Stop,
+		Seed:      request.Seed,
+		User:      request.User,
+	}
+	// go-openai drops a zero temperature or top_p because of omitempty,
+	// which would silently fall back to the API default of 1. Penalties
+	// default to 0, so dropping them is harmless.
+	if request.Temperature != nil {
+		req.Temperature = non_zero(*request.Temperature)
+	}
+	if request.Top_p != nil {
+		req.TopP = non_zero(*request.Top_p)
+	}
+	if request.Presence_penalty != nil {
+		req.PresencePenalty = *request.Presence_penalty
+	}
+	if request.Frequency_penalty != nil {
+		req.FrequencyPenalty = *request.Frequency_penalty
+	}
+	for _, message := range request.Messages {
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+			Role:    message.Role,
+			Content: message.Content,
+		})
 	}
 
-	stream, err := client.CreateChatCompletionStream(context.Background(), req)
+	stream, err := o.Client.CreateChatCompletionStream(ctx, req)
 	if err != nil {
-		fmt.Printf("ChatCompletionStream error: %v", err)
-		return ""
+		return nil, err
+	}
+
+	return openai_stream{stream: stream}, nil
+}
+
+// non_zero replaces 0 with the smallest float32, which go-openai sends.
+func non_zero(value float32) float32 {
+	if value == 0 {
+		return math.SmallestNonzeroFloat32
 	}
-	defer stream.Close()
+	return value
+}
 
-	complete_response := ""
+type openai_stream struct {
+	stream *openai.ChatCompletionStream
+}
 
+func (o openai_stream) Recv() (string, error) {
 	for {
-		response, err := stream.Recv()
-		if errors.Is(err, io.EOF) {
-			break
-		}
+		response, err := o.stream.Recv()
 		if err != nil {
-			fmt.Printf("Stream error: %v\n", err)
-			os.Exit(1)
+			return "", err
+		}
+		if len(response.Choices) > 0 {
+			return response.Choices[0].Delta.Content, nil
 		}
-
-		complete_response += response.Choices[0].Delta.Content
-		streaming_response <- response.Choices[0].Delta.Content
 	}
+}
 
-	close(streaming_response)
-
-	return complete_response
+func (o openai_stream) Close() error {
+	o.stream.Close()
+	return nil
 }
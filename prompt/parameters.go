@@ -0,0 +1,59 @@
+package prompt
+
+// ModelParameters selects the model and sampling settings for a completion.
+// Prompt holds the defaults and RunOptions can override them per call; any
+// field left unset falls back to the provider's default.
+type ModelParameters struct {
+	Model             string
+	Temperature       *float32
+	Top_p             *float32
+	Max_tokens        int
+	Stop              []string
+	Seed              *int
+	Presence_penalty  *float32
+	Frequency_penalty *float32
+	User              string
+}
+
+// Float32 returns a pointer to v, for the optional ModelParameters fields.
+func Float32(v float32) *float32 {
+	return &v
+}
+
+// Int returns a pointer to v, for the optional ModelParameters fields.
+func Int(v int) *int {
+	return &v
+}
+
+// merge returns m with every field that is set in override replaced.
+func (m ModelParameters) merge(override ModelParameters) ModelParameters {
+	if override.Model != "" {
+		m.Model = override.Model
+	}
+	if override.Temperature != nil {
+		m.Temperature = override.Temperature
+	}
+	if override.Top_p != nil {
+		m.Top_p = override.Top_p
+	}
+	if override.Max_tokens != 0 {
+		m.Max_tokens = override.Max_tokens
+	}
+	if override.Stop != nil {
+		m.Stop = override.Stop
+	}
+	if override.Seed != nil {
+		m.Seed = override.Seed
+	}
+	if override.Presence_penalty != nil {
+		m.Presence_penalty = override.Presence_penalty
+	}
+	if override.Frequency_penalty != nil {
+		m.Frequency_penalty = override.Frequency_penalty
+	}
+	if override.User != "" {
+		m.User = override.User
+	}
+
+	return m
+}
@@ -1,125 +1,395 @@
 package prompt
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
 	"reflect"
-	"regexp"
 	"strings"
 
 	"github.com/farant/gpt-statemachine/besteffortjson"
-	"github.com/sashabaranov/go-openai"
 )
 
 type Prompt[Output any, Input any] struct {
-	Prompt           string
-	Json_output      Output
-	Array_of_results bool
-	Arguments        Input
+	Prompt       string
+	System       string
+	Instructions InstructionsPlacement
+	// Syntax is the template syntax of Prompt and System, and Partials
+	// are named templates they can include with Syntax_text_template.
+	Syntax   TemplateSyntax
+	Partials map[string]string
+	// Safe_arguments wraps every argument not tagged prompt:"trusted" in
+	// <name></name> tags when it is rendered, so text from users can't pass
+	// for instructions. Arguments tagged prompt:"untrusted" are wrapped
+	// either way.
+	Safe_arguments bool
+	// Examples are real requests and answers shown to the model, placed
+	// as Example_placement says.
+	Examples          []Example[Output, Input]
+	Example_placement ExamplesPlacement
+	Json_output       Output
+	Array_of_results  bool
+	Arguments         Input
+	// Coercion decides which values in the wrong form, like "1905" for an
+	// int, are converted to the Output field types. nil means
+	// besteffortjson.Default_coercion.
+	Coercion *besteffortjson.Coercion
+	// Key_naming names the JSON keys of Output fields without a json tag
+	// name, in the schema shown to the model and when decoding its answer.
+	// nil means besteffortjson.Snake_case.
+	Key_naming besteffortjson.Key_naming
+	ModelParameters
+
+	// compiled is set by Compile.
+	compiled *compiled_templates
 }
 
 type RunOptions[Output any, Input any] struct {
+	// On_json_array_progress is called on every delta with the results so
+	// far, the last one possibly unfinished. Its slot is filled in again by
+	// the next call, so copy the slice to keep that item as it was.
 	On_json_array_progress func([]Output, string)
-	Arguments              Input
+	// On_json_object_progress is the single-object counterpart of
+	// On_json_array_progress, called with the partially filled in Output.
+	// The slices and maps in it are filled in again by the next call, so copy
+	// them to keep them as they were.
+	On_json_object_progress func(partial Output, raw string)
+	// On_item_started and On_item_completed are called exactly once for each
+	// element of the results array: when the model starts writing it, and
+	// when it has been closed and decoded.
+	On_item_started   func(index int)
+	On_item_completed func(index int, item Output)
+	Arguments         Input
+	// Messages are earlier turns of the conversation, for example the
+	// Messages of a previous PromptResult.
+	Messages []ChatMessage
+	ModelParameters
 }
 
 type PromptResult[Output any] struct {
+	// Parsed_result is set when Array_of_results is false, and
+	// Parsed_results_array when it is true.
+	Parsed_result        Output
 	Parsed_results_array []Output
 	Parsed_results_json  string
 	Prompt_text          string
 	Response_text        string
+	// Messages is the whole conversation including the assistant's reply,
+	// ready to pass as RunOptions.Messages to continue it.
+	Messages []ChatMessage
+	// Diagnostics lists the values in the response that didn't fit the
+	// Output type and were skipped. Everything else is still parsed.
+	Diagnostics besteffortjson.Diagnostics
 }
 
-func (p Prompt[Output, Input]) Run(client *openai.Client, options RunOptions[Output, Input]) PromptResult[Output] {
-	streaming_response := make(chan string)
+func (p Prompt[Output, Input]) Run(provider Provider, options RunOptions[Output, Input]) (PromptResult[Output], error) {
+	return p.RunContext(context.Background(), provider, options)
+}
 
-	if options.On_json_array_progress != nil {
-		if !p.Array_of_results {
-			panic(fmt.Errorf("on_json_array_progress requires Array_of_results to be true"))
-		}
+// RunContext is Run with a context that is passed down to the provider. If the
+// context is cancelled mid-stream, the result holds whatever was parsed from
+// the partial response and the error is ctx.Err().
+func (p Prompt[Output, Input]) RunContext(ctx context.Context, provider Provider, options RunOptions[Output, Input]) (PromptResult[Output], error) {
+	array_progress := options.On_json_array_progress != nil || options.On_item_started != nil || options.On_item_completed != nil
+	if array_progress && !p.Array_of_results {
+		return PromptResult[Output]{}, ErrProgressRequiresArray
+	}
+	if options.On_json_object_progress != nil && p.Array_of_results {
+		return PromptResult[Output]{}, ErrProgressRequiresObject
+	}
 
-		go func() {
-			total_progress := ""
-			for response := range streaming_response {
-				total_progress += response
-				result_json := besteffortjson.Best_effort_json_parse(total_progress)
+	messages, err := p.Generate_messages(options)
+	if err != nil {
+		return PromptResult[Output]{}, err
+	}
 
-				var response struct {
-					Results []Output `json:"results"`
-				}
+	var handler progress_handler
+	if array_progress || options.On_json_object_progress != nil {
+		tracker := item_tracker{objects: p.output_is_object()}
+		items := item_cache[Output]{}
+		decoder := p.decoder()
+		// The object is decoded incrementally into the same value on every
+		// delta, the Result field unless wraps_result.
+		incremental := besteffortjson.Incremental_decoder{Decoder: decoder}
+		var object struct {
+			Result Output `json:"result"`
+		}
+		parser := besteffortjson.NewStreamParser()
+		parser.Options = besteffortjson.Lenient
+		handler = func(delta string, total_progress string) error {
+			parser.Write(delta)
+			document, found := parser.Document()
+			if !found {
+				return nil
+			}
 
-				err := json.Unmarshal([]byte(result_json), &response)
-				if err != nil {
-					log.Println("JSON parse error: ", err)
-					return
+			if options.On_json_object_progress != nil {
+				// Partial results that don't decode yet are skipped, the
+				// final parse reports the error if it persists.
+				var target interface{} = &object.Result
+				if p.wraps_result() {
+					target = &object
+				}
+				if p.shape_problem(incremental.Decode_document(document, target)) == nil {
+					options.On_json_object_progress(object.Result, total_progress)
 				}
+				return nil
+			}
 
-				options.On_json_array_progress(response.Results, total_progress)
+			events := tracker.feed(parser)
+			results := items.update(decoder, document, tracker)
+			for _, event := range events {
+				if !event.completed && options.On_item_started != nil {
+					options.On_item_started(event.index)
+				}
+				if event.completed && options.On_item_completed != nil {
+					options.On_item_completed(event.index, results[event.index])
+				}
 			}
-		}()
+			if options.On_json_array_progress != nil {
+				options.On_json_array_progress(results, total_progress)
+			}
+			return nil
+		}
 	}
 
-	prompt := p.Generate_prompt(options)
+	streaming_response := make(chan string, stream_buffer)
+	progress_done := start_progress(ctx, streaming_response, handler)
 
-	raw_response := run_prompt(prompt, client, streaming_response)
+	request := ChatRequest{
+		Messages:        messages,
+		ModelParameters: p.ModelParameters.merge(options.ModelParameters),
+	}
+
+	raw_response, err := run_prompt(ctx, request, provider, streaming_response)
+	progress_err := <-progress_done
 
 	result := PromptResult[Output]{
-		Prompt_text:   prompt,
+		Prompt_text:   messages[len(messages)-1].Content,
 		Response_text: raw_response,
+		Messages:      append(messages, ChatMessage{Role: Role_assistant, Content: raw_response}),
+	}
+	if err != nil && ctx.Err() != nil {
+		p.parse_response(raw_response, &result)
+		return result, err
+	}
+	if err != nil {
+		return result, err
 	}
 
-	results_json := besteffortjson.Best_effort_json_parse(raw_response)
+	parse_err := p.parse_response(raw_response, &result)
+	if progress_err != nil {
+		return result, progress_err
+	}
+
+	return result, parse_err
+}
 
-	var response struct {
-		Results []Output `json:"results"`
+// parse_response fills in the parsed fields of result from a complete or
+// partial response.
+func (p Prompt[Output, Input]) parse_response(response_text string, result *PromptResult[Output]) error {
+	parser := besteffortjson.NewStreamParser()
+	parser.Options = besteffortjson.Lenient
+	parser.Write(response_text)
+
+	document, found := parser.Document()
+	result.Parsed_results_json = document.Snapshot()
+	if !found {
+		return &ParseError{Response: response_text, Err: ErrNoJson}
 	}
-	err := json.Unmarshal([]byte(results_json), &response)
-	if err != nil {
-		log.Println("JSON parse error: ", err)
+	if problem := p.decode_document(p.decoder(), document, result); problem != nil {
+		return &SchemaError{Json: result.Parsed_results_json, Err: *problem}
 	}
+	return nil
+}
 
-	result.Parsed_results_array = response.Results
-	result.Parsed_results_json = results_json
+// decoder is the Decoder responses are decoded with.
+func (p Prompt[Output, Input]) decoder() besteffortjson.Decoder {
+	decoder := besteffortjson.Decoder{
+		Options:    besteffortjson.Lenient,
+		Coercion:   besteffortjson.Default_coercion,
+		Key_naming: p.key_naming(),
+	}
+	if p.Coercion != nil {
+		decoder.Coercion = *p.Coercion
+	}
+	return decoder
+}
 
-	return result
+// decode_document fills in the parsed results of result from the best-effort
+// JSON recovered from a response. Values that don't fit the Output type are
+// skipped and listed in result.Diagnostics; the diagnostic that makes the
+// overall shape of the document wrong, if any, is returned.
+func (p Prompt[Output, Input]) decode_document(decoder besteffortjson.Decoder, document besteffortjson.Document, result *PromptResult[Output]) *besteffortjson.Diagnostic {
+	if p.Array_of_results && document.Is_array("") {
+		// Models asked for {"results": [...]} sometimes answer with the
+		// bare array.
+		result.Diagnostics = decoder.Decode_document(document, &result.Parsed_results_array)
+	} else if p.Array_of_results {
+		var response struct {
+			Results []Output `json:"results"`
+		}
+		result.Diagnostics = decoder.Decode_document(document, &response)
+		result.Parsed_results_array = response.Results
+		// Without the key the model answered in another shape, which
+		// isn't the same as an answer with no results.
+		if _, found := document.Is_complete("/results"); !found {
+			result.Diagnostics = append(result.Diagnostics, besteffortjson.Diagnostic{Path: "/results", Err: besteffortjson.ErrNoValue})
+		}
+	} else if p.wraps_result() {
+		var response struct {
+			Result Output `json:"result"`
+		}
+		result.Diagnostics = decoder.Decode_document(document, &response)
+		result.Parsed_result = response.Result
+	} else {
+		result.Diagnostics = decoder.Decode_document(document, &result.Parsed_result)
+	}
+
+	return p.shape_problem(result.Diagnostics)
+}
+
+// shape_problem returns the diagnostic that makes the overall shape of the
+// document wrong, if any.
+func (p Prompt[Output, Input]) shape_problem(diagnostics besteffortjson.Diagnostics) *besteffortjson.Diagnostic {
+	for i, diagnostic := range diagnostics {
+		if diagnostic.Path == "" || (p.Array_of_results && diagnostic.Path == "/results") || (p.wraps_result() && diagnostic.Path == "/result") {
+			return &diagnostics[i]
+		}
+	}
+	return nil
 }
 
-func (p Prompt[Output, Input]) StructToMap(obj interface{}) map[string]interface{} {
+// StructToMap lists the exported fields of a struct, or of the struct a
+// pointer points to, by name. Maps with string keys are returned as they are.
+func (p Prompt[Output, Input]) StructToMap(obj interface{}) (map[string]interface{}, error) {
 	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+
 	out := make(map[string]interface{})
+	switch {
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				out[v.Type().Field(i).Name] = v.Field(i).Interface()
+			}
+		}
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		iter := v.MapRange()
+		for iter.Next() {
+			out[iter.Key().String()] = iter.Value().Interface()
+		}
+	default:
+		return nil, fmt.Errorf("arguments must be a struct or a map with string keys, not %T", obj)
+	}
+
+	return out, nil
+}
 
-	for i := 0; i < v.NumField(); i++ {
-		key := v.Type().Field(i).Name
-		value := v.Field(i).Interface()
+// InstructionsPlacement decides which message carries the JSON format
+// instructions.
+type InstructionsPlacement int
 
-		out[key] = value
+const (
+	Instructions_in_user InstructionsPlacement = iota
+	Instructions_in_system
+)
+
+// Generate_prompt renders the user message: the prompt text with its
+// placeholders filled in, followed by the JSON format instructions unless
+// they are placed in the system message.
+func (p Prompt[Output, Input]) Generate_prompt(options RunOptions[Output, Input]) (string, error) {
+	prompt, err := p.render(p.Prompt, options.Arguments)
+	if err != nil {
+		return "", err
 	}
 
-	return out
+	if p.Instructions == Instructions_in_user {
+		instructions, err := p.format_section()
+		if err != nil {
+			return "", err
+		}
+		prompt += "\n\n" + instructions
+	}
+
+	return prompt, nil
 }
 
-func (p Prompt[Output, Input]) Generate_prompt(options RunOptions[Output, Input]) string {
-	prompt := p.Prompt
-	re := regexp.MustCompile(`{{(\w+)}}`)
-	matches := re.FindAllStringSubmatch(prompt, -1)
-	arguments_map := p.StructToMap(options.Arguments)
-	for _, match := range matches {
-		keyword := match[1]
-		if val, ok := arguments_map[match[1]]; ok {
-			prompt = strings.Replace(prompt, match[0], fmt.Sprintf("%v", val), -1)
-		} else {
-			panic(fmt.Errorf("argument not found in options %s", keyword))
+// Generate_system_prompt renders the system message. It is empty if the
+// prompt has no System text and the format instructions go in the user
+// message.
+func (p Prompt[Output, Input]) Generate_system_prompt(options RunOptions[Output, Input]) (string, error) {
+	system, err := p.render(p.System, options.Arguments)
+	if err != nil {
+		return "", err
+	}
+
+	if p.Instructions == Instructions_in_system {
+		instructions, err := p.format_section()
+		if err != nil {
+			return "", err
 		}
+		if system != "" {
+			system += "\n\n"
+		}
+		system += instructions
 	}
 
-	prompt += "\n\n"
+	return system, nil
+}
+
+// Generate_messages builds the conversation sent to the provider: the system
+// message, the prior turns from options.Messages and the new user message. A
+// leading system message in the prior turns is replaced by this prompt's
+// system message when it has one. Examples_as_turns go before the prior
+// turns, unless there are any: a continued conversation has them already.
+func (p Prompt[Output, Input]) Generate_messages(options RunOptions[Output, Input]) ([]ChatMessage, error) {
+	system, err := p.Generate_system_prompt(options)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := p.Generate_prompt(options)
+	if err != nil {
+		return nil, err
+	}
+
+	history := options.Messages
+	var messages []ChatMessage
+	if system != "" {
+		messages = append(messages, ChatMessage{Role: Role_system, Content: system})
+		if len(history) > 0 && history[0].Role == Role_system {
+			history = history[1:]
+		}
+	}
+	if len(history) == 0 {
+		turns, err := p.example_turns()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, turns...)
+	}
+	messages = append(messages, history...)
+	messages = append(messages, ChatMessage{Role: Role_user, Content: user})
+
+	return messages, nil
+}
+
+// Generate_format_instructions describes the JSON the model should answer
+// with, including an example built from Json_output.
+func (p Prompt[Output, Input]) Generate_format_instructions() string {
+	output := describe_type(p.output_type(), p.key_naming())
+	counter := 1
+	instructions := ""
 	if p.Array_of_results {
-		prompt += "In your response send me an array of JSON objects. Don't include any markdown block syntax."
-		prompt += "Here's an example result to match:\n\n"
-		counter := 1
-		prompt += strings.TrimSpace(fmt.Sprintf(`
+		if output.kind == shape_object {
+			instructions += "In your response send me an array of JSON objects. Don't include any markdown block syntax.\n"
+		} else {
+			instructions += "In your response send me an array of JSON values. Don't include any markdown block syntax.\n"
+		}
+		instructions += "Here's an example result to match:\n\n"
+		instructions += strings.TrimSpace(fmt.Sprintf(`
 {
 	"results": [
 		%s,
@@ -128,68 +398,15 @@ func (p Prompt[Output, Input]) Generate_prompt(options RunOptions[Output, Input]
 		}
 			`, p.Struct_to_prompt_schema(p.Json_output, &counter)))
 	} else {
-		prompt += "In your response send me a JSON object. Don't include any markdown block syntax.\n"
-		prompt += "Here's an example result to match:\n\n"
-		counter := 1
-		prompt += p.Struct_to_prompt_schema(p.Json_output, &counter)
-	}
-
-	return prompt
-}
-
-func (p Prompt[Output, Input]) Struct_to_prompt_schema(struct_type interface{}, something_counter *int) string {
-	v := reflect.ValueOf(struct_type)
-	typeOfS := v.Type()
-
-	next_something := func() string {
-		result := "something" + fmt.Sprintf("%d", *something_counter)
-		(*something_counter)++
-		return result
-	}
-
-	output := "{\n"
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		var example_value string
-		switch field.Kind() {
-		case reflect.Slice:
-			elemType := field.Type().Elem()
-			if elemType.Kind() == reflect.Int {
-				example_value = "[123, 456]"
-			} else if elemType.Kind() == reflect.Struct {
-				example_value = fmt.Sprintf("[%s, %s]", p.Struct_to_prompt_schema(reflect.New(elemType).Elem().Interface(), something_counter), p.Struct_to_prompt_schema(reflect.New(elemType).Elem().Interface(), something_counter))
-			} else {
-				example_value = fmt.Sprintf("[\"%s\", \"%s\"]", next_something(), next_something())
-			}
-		case reflect.Struct:
-			example_value = p.Struct_to_prompt_schema(field.Interface(), something_counter)
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			example_value = "123"
-		case reflect.Float32, reflect.Float64:
-			example_value = "123.0"
-		default:
-			example_value = fmt.Sprintf("\"%s\"", next_something())
-		}
-
-		if i != v.NumField()-1 {
-			output += fmt.Sprintf(
-				"\t\"%s\": %s,\n",
-				To_snake_case(typeOfS.Field(i).Name),
-				example_value,
-			)
-		} else {
-			output += fmt.Sprintf(
-				"\t\"%s\": %s",
-				To_snake_case(typeOfS.Field(i).Name),
-				example_value,
-			)
+		instructions += "In your response send me a JSON object. Don't include any markdown block syntax.\n"
+		instructions += "Here's an example result to match:\n\n"
+		if p.wraps_result() {
+			output = &type_shape{kind: shape_object, fields: []shape_field{{name: "result", shape: output}}}
 		}
+		writer := schema_writer{counter: &counter}
+		writer.value(output, 0, false, field_hints{})
+		instructions += writer.output.String()
 	}
 
-	output += "\n}"
-
-	var prettyJSON bytes.Buffer
-	json.Indent(&prettyJSON, []byte(output), "", "\t")
-	output = prettyJSON.String()
-	return output
+	return instructions
 }
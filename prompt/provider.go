@@ -0,0 +1,69 @@
+package prompt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	Role_system    = "system"
+	Role_user      = "user"
+	Role_assistant = "assistant"
+)
+
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+type ChatRequest struct {
+	Messages []ChatMessage
+	ModelParameters
+}
+
+// ChatStream yields the content deltas of a streamed completion. Recv returns
+// io.EOF once the completion is finished.
+type ChatStream interface {
+	Recv() (string, error)
+	Close() error
+}
+
+// Provider is anything that can stream a chat completion.
+type Provider interface {
+	Stream(ctx context.Context, request ChatRequest) (ChatStream, error)
+}
+
+func run_prompt(ctx context.Context, request ChatRequest, provider Provider, streaming_response chan<- string) (string, error) {
+	defer close(streaming_response)
+
+	stream, err := provider.Stream(ctx, request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", &TransportError{Err: err}
+	}
+	defer stream.Close()
+
+	var complete_response strings.Builder
+
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return complete_response.String(), ctx.Err()
+			}
+			return complete_response.String(), &TransportError{Err: err}
+		}
+
+		complete_response.WriteString(response)
+		streaming_response <- response
+	}
+
+	return complete_response.String(), nil
+}
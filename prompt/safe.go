@@ -0,0 +1,327 @@
+package prompt
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/farant/gpt-statemachine/besteffortjson"
+)
+
+// argument_trust says which arguments are wrapped in tags when they are
+// rendered: those tagged prompt:"untrusted", and with Safe_arguments all
+// those not tagged prompt:"trusted".
+type argument_trust struct {
+	// tags maps the fields to wrap to the name of their tag.
+	tags map[string]string
+	// trusted are the other fields. Names that are neither, like methods of
+	// the arguments, are wrapped as long as any field is.
+	trusted map[string]bool
+	// all is set for map arguments with Safe_arguments, whose keys aren't
+	// known in advance.
+	all bool
+}
+
+func (p Prompt[Output, Input]) argument_trust() argument_trust {
+	t := reflect.TypeOf((*Input)(nil)).Elem()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	trust := argument_trust{tags: map[string]string{}, trusted: map[string]bool{}}
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("prompt")
+			if tag == "untrusted" || (p.Safe_arguments && tag != "trusted") {
+				trust.tags[field.Name] = besteffortjson.Snake_case(field.Name)
+			} else {
+				trust.trusted[field.Name] = true
+			}
+		}
+	case reflect.Map, reflect.Interface:
+		trust.all = p.Safe_arguments
+	}
+	return trust
+}
+
+// tag returns the tag to wrap the argument name in, if it is untrusted.
+func (a argument_trust) tag(name string) (string, bool) {
+	if tag, ok := a.tags[name]; ok {
+		return tag, true
+	}
+	if a.all || (!a.trusted[name] && len(a.tags) > 0) {
+		return besteffortjson.Snake_case(name), true
+	}
+	return "", false
+}
+
+// any_tag is the tag to wrap values that mix several arguments in.
+func (a argument_trust) any_tag() string {
+	if a.all {
+		return "arguments"
+	}
+	names := make([]string, 0, len(a.tags))
+	for name := range a.tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return a.tags[names[0]]
+}
+
+// Wrap_untrusted formats value and wraps it in <tag></tag>, on its own lines
+// if it spans several. Tags with the same name inside value are escaped, so
+// the value can't close the block early and pass for instructions.
+func Wrap_untrusted(tag string, value interface{}) string {
+	text := fmt.Sprint(value)
+	collision := regexp.MustCompile(`(?i)<(/?` + regexp.QuoteMeta(tag) + `)\b`)
+	text = collision.ReplaceAllString(text, "&lt;$1")
+
+	if strings.Contains(text, "\n") {
+		return "<" + tag + ">\n" + text + "\n</" + tag + ">"
+	}
+	return "<" + tag + ">" + text + "</" + tag + ">"
+}
+
+// wrap_untrusted_actions rewrites the actions of the templates that print
+// untrusted arguments, or values computed from them, to pipe them through the
+// untrusted helper. Partials are assumed to be called with the arguments as
+// dot, and calling one with an untrusted value is an error, since what it
+// prints from it can't be told apart from the arguments.
+func wrap_untrusted_actions(tmpl *template.Template, trust argument_trust) error {
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		rewriter := action_rewriter{tree: t.Tree, trust: trust, variables: map[*parse.VariableNode]taint{}}
+		// Variables can be assigned untrusted values after an action that
+		// prints them, inside a range, so the tree is walked until no more
+		// variables are found untrusted before anything is rewritten.
+		for changed := true; changed; {
+			rewriter.changed = false
+			rewriter.walk(t.Tree.Root, new_scope(nil), taint{root: true})
+			changed = rewriter.changed
+		}
+		rewriter.rewrite = true
+		rewriter.walk(t.Tree.Root, new_scope(nil), taint{root: true})
+		if rewriter.err != nil {
+			return rewriter.err
+		}
+	}
+	return nil
+}
+
+// taint is what the rewriter knows about a value: whether it is the
+// arguments, whose fields each have their own trust, and the tag of the
+// untrusted argument it comes from, if any.
+type taint struct {
+	root bool
+	tag  string
+}
+
+func (t taint) merge(other taint) taint {
+	if t.tag == "" {
+		t.tag = other.tag
+	}
+	t.root = t.root || other.root
+	return t
+}
+
+// scope maps the variables visible at a point of a template to the node
+// that declares them, which is what the taint of a variable is kept by.
+type scope struct {
+	parent    *scope
+	variables map[string]*parse.VariableNode
+}
+
+func new_scope(parent *scope) *scope {
+	return &scope{parent: parent, variables: map[string]*parse.VariableNode{}}
+}
+
+func (s *scope) lookup(name string) *parse.VariableNode {
+	for ; s != nil; s = s.parent {
+		if declaration, ok := s.variables[name]; ok {
+			return declaration
+		}
+	}
+	return nil
+}
+
+type action_rewriter struct {
+	tree      *parse.Tree
+	trust     argument_trust
+	variables map[*parse.VariableNode]taint
+	// changed is set when a walk finds a variable more untrusted than before.
+	changed bool
+	// rewrite is set for the last walk, which rewrites the actions.
+	rewrite bool
+	err     error
+}
+
+// walk rewrites the actions under node, where dot is the value of dot.
+func (r *action_rewriter) walk(node parse.Node, s *scope, dot taint) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			r.walk(child, s, dot)
+		}
+	case *parse.ActionNode:
+		value := r.pipe(node.Pipe, s, dot)
+		r.declare(node.Pipe, s, value)
+		// Actions that declare variables print nothing.
+		if tag := r.printed(value); r.rewrite && tag != "" && len(node.Pipe.Decl) == 0 {
+			node.Pipe.Cmds = append(node.Pipe.Cmds, r.untrusted_command(node.Position(), tag))
+		}
+	case *parse.IfNode:
+		inner := new_scope(s)
+		r.declare(node.Pipe, inner, r.pipe(node.Pipe, inner, dot))
+		r.walk(node.List, new_scope(inner), dot)
+		r.walk(node.ElseList, new_scope(inner), dot)
+	case *parse.RangeNode:
+		inner := new_scope(s)
+		value := r.pipe(node.Pipe, inner, dot)
+		element := taint{tag: r.printed(value)}
+		r.declare(node.Pipe, inner, element)
+		r.walk(node.List, new_scope(inner), element)
+		r.walk(node.ElseList, new_scope(inner), dot)
+	case *parse.WithNode:
+		inner := new_scope(s)
+		value := r.pipe(node.Pipe, inner, dot)
+		r.declare(node.Pipe, inner, value)
+		r.walk(node.List, new_scope(inner), value)
+		r.walk(node.ElseList, new_scope(inner), dot)
+	case *parse.TemplateNode:
+		var value taint
+		if node.Pipe != nil {
+			value = r.pipe(node.Pipe, s, dot)
+			r.declare(node.Pipe, s, value)
+		}
+		if value.tag != "" && r.err == nil {
+			r.err = fmt.Errorf("{{template %q}} is called with the untrusted argument %q: pass it . or $ and let it print the argument", node.Name, value.tag)
+		}
+	}
+}
+
+// pipe returns the taint of the value of a pipeline. The result of a
+// function or method is untrusted if any of its arguments is.
+func (r *action_rewriter) pipe(pipe *parse.PipeNode, s *scope, dot taint) taint {
+	var value taint
+	if pipe == nil {
+		return value
+	}
+	for i, command := range pipe.Cmds {
+		var arguments []taint
+		for _, arg := range command.Args {
+			arguments = append(arguments, r.arg(arg, s, dot))
+		}
+		if i == 0 && len(arguments) == 1 {
+			value = arguments[0]
+			continue
+		}
+		if i > 0 {
+			arguments = append(arguments, value)
+		}
+		value = taint{}
+		for _, argument := range arguments {
+			if value.tag == "" {
+				value.tag = r.printed(argument)
+			}
+		}
+	}
+	return value
+}
+
+// declare records the taint of the variables a pipeline declares or assigns.
+// Variables only ever become more untrusted, so a later walk sees every value
+// they can hold.
+func (r *action_rewriter) declare(pipe *parse.PipeNode, s *scope, value taint) {
+	if pipe == nil {
+		return
+	}
+	for _, variable := range pipe.Decl {
+		declaration := variable
+		if pipe.IsAssign {
+			declaration = s.lookup(variable.Ident[0])
+		} else {
+			s.variables[variable.Ident[0]] = variable
+		}
+		if declaration == nil {
+			continue
+		}
+		merged := r.variables[declaration].merge(value)
+		if merged != r.variables[declaration] {
+			r.variables[declaration] = merged
+			r.changed = true
+		}
+	}
+}
+
+func (r *action_rewriter) arg(node parse.Node, s *scope, dot taint) taint {
+	switch node := node.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return r.field(dot, node.Ident)
+	case *parse.VariableNode:
+		if node.Ident[0] == "$" {
+			return r.field(taint{root: true}, node.Ident[1:])
+		}
+		declaration := s.lookup(node.Ident[0])
+		if declaration == nil {
+			return taint{tag: r.trust.any_tag()}
+		}
+		return r.field(r.variables[declaration], node.Ident[1:])
+	case *parse.ChainNode:
+		return r.field(r.arg(node.Node, s, dot), node.Field)
+	case *parse.PipeNode:
+		value := r.pipe(node, s, dot)
+		r.declare(node, s, value)
+		return value
+	}
+	return taint{}
+}
+
+// field returns the taint of the value at the end of a chain of fields.
+func (r *action_rewriter) field(value taint, fields []string) taint {
+	if len(fields) == 0 || value.tag != "" {
+		return value
+	}
+	if value.root {
+		tag, _ := r.trust.tag(fields[0])
+		return taint{tag: tag}
+	}
+	return taint{}
+}
+
+// printed returns the tag a value is wrapped in when it is printed. The
+// arguments as a whole are wrapped as soon as one of them is untrusted.
+func (r *action_rewriter) printed(value taint) string {
+	if value.tag == "" && value.root {
+		return r.trust.any_tag()
+	}
+	return value.tag
+}
+
+func (r *action_rewriter) untrusted_command(position parse.Pos, tag string) *parse.CommandNode {
+	identifier := parse.NewIdentifier("untrusted").SetTree(r.tree).SetPos(position)
+	return &parse.CommandNode{
+		NodeType: parse.NodeCommand,
+		Pos:      position,
+		Args: []parse.Node{
+			identifier,
+			&parse.StringNode{NodeType: parse.NodeString, Pos: position, Quoted: strconv.Quote(tag), Text: tag},
+		},
+	}
+}
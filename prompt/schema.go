@@ -0,0 +1,315 @@
+package prompt
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/farant/gpt-statemachine/besteffortjson"
+)
+
+// key_naming is the naming used for fields without a json tag name, both in
+// the schema and when decoding the response.
+func (p Prompt[Output, Input]) key_naming() besteffortjson.Key_naming {
+	if p.Key_naming == nil {
+		return besteffortjson.Snake_case
+	}
+	return p.Key_naming
+}
+
+// output_type is the type of Output, or of Json_output when Output is an
+// interface.
+func (p Prompt[Output, Input]) output_type() reflect.Type {
+	t := reflect.TypeOf((*Output)(nil)).Elem()
+	if t.Kind() == reflect.Interface {
+		if dynamic := reflect.TypeOf(any(p.Json_output)); dynamic != nil {
+			return dynamic
+		}
+	}
+	return t
+}
+
+// wraps_result reports whether the response is an object with the result in
+// it, {"result": ...}, because the Output isn't an object by itself.
+func (p Prompt[Output, Input]) wraps_result() bool {
+	return !p.Array_of_results && !p.output_is_object()
+}
+
+// output_is_object reports whether an Output is a JSON object.
+func (p Prompt[Output, Input]) output_is_object() bool {
+	t := p.output_type()
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	kind, _ := kind_of(t)
+	return kind == shape_object || kind == shape_map
+}
+
+// Struct_to_prompt_schema renders an example value of the struct for the
+// model to copy, with the keys the response is decoded with. Any type works,
+// not only structs, and recursive structs are written out once. Example values
+// come from the desc, example, enum, min, max and format tags of the fields
+// where they are set, and the tags, along with omitempty, are also written as
+// a comment after the field.
+func (p Prompt[Output, Input]) Struct_to_prompt_schema(struct_type interface{}, something_counter *int) string {
+	writer := schema_writer{counter: something_counter}
+	writer.value(describe_type(reflect.TypeOf(struct_type), p.key_naming()), 0, false, field_hints{})
+	return writer.output.String()
+}
+
+type schema_writer struct {
+	output  strings.Builder
+	counter *int
+}
+
+func (w *schema_writer) next_something() string {
+	result := fmt.Sprintf("something%d", *w.counter)
+	(*w.counter)++
+	return result
+}
+
+func (w *schema_writer) indent(depth int) {
+	w.output.WriteString(strings.Repeat("\t", depth))
+}
+
+// value writes an example of a value of the shape, following the hints of
+// the field it belongs to. quoted writes numbers as strings, for fields with
+// the ",string" tag option.
+func (w *schema_writer) value(shape *type_shape, depth int, quoted bool, hints field_hints) {
+	switch {
+	case shape.cycle != nil:
+		// A recursive struct is written out once, where it first appears.
+		w.output.WriteString("{}")
+	case shape.kind == shape_object:
+		w.object(shape, depth)
+	case shape.kind == shape_array:
+		examples := split_list(hints.example)
+		w.output.WriteString("[\n")
+		for i := 0; i < 2; i++ {
+			w.indent(depth + 1)
+			example := ""
+			if i < len(examples) {
+				example = examples[i]
+			}
+			w.element(shape.elem, depth+1, quoted, hints, example, i)
+			if i == 0 {
+				w.output.WriteString(",")
+			}
+			w.output.WriteString("\n")
+		}
+		w.indent(depth)
+		w.output.WriteString("]")
+	case shape.kind == shape_map:
+		w.output.WriteString("{\n")
+		w.indent(depth + 1)
+		if shape.key.kind == shape_integer {
+			w.output.WriteString(`"123": `)
+		} else {
+			w.output.WriteString(json_quote(w.next_something()) + ": ")
+		}
+		w.element(shape.elem, depth+1, quoted, hints, "", 0)
+		w.output.WriteString("\n")
+		w.indent(depth)
+		w.output.WriteString("}")
+	default:
+		w.output.WriteString(w.scalar(shape, hints.example, hints, 0, quoted))
+	}
+}
+
+// element writes the index-th element of an array or value of a map. The
+// enum and format of the field are those of its elements, but min and max
+// count the elements.
+func (w *schema_writer) element(shape *type_shape, depth int, quoted bool, hints field_hints, example string, index int) {
+	hints = field_hints{enum: hints.enum, format: hints.format}
+	if shape.is_container() || shape.cycle != nil {
+		w.value(shape, depth, quoted, hints)
+		return
+	}
+	w.output.WriteString(w.scalar(shape, example, hints, index, quoted))
+}
+
+// format_examples are example values for the format tag.
+var format_examples = map[string]string{
+	"date":      "2024-01-31",
+	"date-time": "2024-01-31T09:30:00Z",
+	"time":      "09:30:00",
+	"year":      "1905",
+	"email":     "ada@example.com",
+	"uri":       "https://example.com",
+	"url":       "https://example.com",
+	"uuid":      "123e4567-e89b-12d3-a456-426614174000",
+}
+
+// scalar returns the example for the index-th value of a field that isn't an
+// object or array: its example tag, an enum value, its bounds or the format,
+// and a placeholder when there are no hints.
+func (w *schema_writer) scalar(shape *type_shape, example string, hints field_hints, index int, quoted bool) string {
+	var candidates []string
+	if example != "" {
+		candidates = append(candidates, example)
+	}
+	if len(hints.enum) > 0 {
+		candidates = append(candidates, hints.enum[index%len(hints.enum)])
+	}
+
+	switch shape.kind {
+	case shape_integer, shape_number:
+		number := "123"
+		if index > 0 {
+			number = "456"
+		}
+		if shape.kind == shape_number {
+			number += ".0"
+		}
+
+		candidates = append(candidates, hints.min, hints.max, format_examples[hints.format])
+		for _, candidate := range candidates {
+			if _, err := strconv.ParseFloat(candidate, 64); err == nil {
+				number = candidate
+				break
+			}
+		}
+		if quoted {
+			return json_quote(number)
+		}
+		return number
+	case shape_boolean:
+		boolean := strconv.FormatBool(index == 0)
+		for _, candidate := range candidates {
+			if candidate == "true" || candidate == "false" {
+				boolean = candidate
+				break
+			}
+		}
+		if quoted {
+			return json_quote(boolean)
+		}
+		return boolean
+	case shape_any:
+		if len(candidates) == 0 {
+			return "null"
+		}
+	}
+
+	if len(candidates) > 0 {
+		return json_quote(candidates[0])
+	}
+	if format_example, ok := format_examples[hints.format]; ok {
+		return json_quote(format_example)
+	}
+	if format_example, ok := format_examples[shape.format]; ok {
+		return json_quote(format_example)
+	}
+	return json_quote(w.next_something())
+}
+
+func json_quote(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+func (w *schema_writer) object(shape *type_shape, depth int) {
+	fields := shape.fields
+	if len(fields) == 0 {
+		w.output.WriteString("{}")
+		return
+	}
+
+	w.output.WriteString("{\n")
+	for i, field := range fields {
+		w.indent(depth + 1)
+		w.output.WriteString(json_quote(field.name) + ": ")
+		w.value(field.shape, depth+1, field.quoted, field.hints)
+		if i < len(fields)-1 {
+			w.output.WriteString(",")
+		}
+		if comment := field.hints.comment(field.shape, field.optional); comment != "" {
+			w.output.WriteString(" // " + comment)
+		}
+		w.output.WriteString("\n")
+	}
+	w.indent(depth)
+	w.output.WriteString("}")
+}
+
+// field_hints are the struct tags that tell the model more about a field than
+// its type does:
+//
+//	desc:"..."      what the field means
+//	example:"..."   an example value, comma separated for slices
+//	enum:"a,b,c"    the values allowed
+//	min:"1" max:"5" bounds of a number, or the length of a string or slice
+//	format:"date"   the format of a string, like date, date-time or email
+type field_hints struct {
+	desc    string
+	example string
+	enum    []string
+	min     string
+	max     string
+	format  string
+}
+
+func hints_of(tag reflect.StructTag) field_hints {
+	return field_hints{
+		desc:    tag.Get("desc"),
+		example: tag.Get("example"),
+		enum:    split_list(tag.Get("enum")),
+		min:     tag.Get("min"),
+		max:     tag.Get("max"),
+		format:  tag.Get("format"),
+	}
+}
+
+func split_list(list string) []string {
+	if list == "" {
+		return nil
+	}
+
+	items := strings.Split(list, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+// comment is the inline guidance written after a field.
+func (h field_hints) comment(shape *type_shape, optional bool) string {
+	var parts []string
+	if h.desc != "" {
+		parts = append(parts, h.desc)
+	}
+	if len(h.enum) > 0 {
+		parts = append(parts, "one of: "+strings.Join(h.enum, ", "))
+	}
+
+	unit := ""
+	switch shape.kind {
+	case shape_string:
+		unit = " characters"
+	case shape_array:
+		unit = " items"
+	}
+	switch {
+	case h.min != "" && h.max != "":
+		parts = append(parts, fmt.Sprintf("between %s and %s%s", h.min, h.max, unit))
+	case h.min != "":
+		parts = append(parts, fmt.Sprintf("at least %s%s", h.min, unit))
+	case h.max != "":
+		parts = append(parts, fmt.Sprintf("at most %s%s", h.max, unit))
+	}
+
+	if h.format != "" {
+		parts = append(parts, "format: "+h.format)
+	}
+	if target := shape.cycle_target(); target != nil {
+		parts = append(parts, "same structure as the enclosing "+target.t.Name())
+	} else if shape.kind == shape_any {
+		parts = append(parts, "any JSON value")
+	}
+	if optional {
+		parts = append(parts, "optional")
+	}
+	return strings.Join(parts, "; ")
+}
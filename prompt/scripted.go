@@ -0,0 +1,96 @@
+package prompt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ScriptedProvider replays canned responses without touching the network.
+// Every call to Stream consumes the next entry of Responses, and each entry is
+// streamed back one chunk at a time, waiting Chunk_delay before each chunk.
+// Requests records what was sent.
+type ScriptedProvider struct {
+	Responses   [][]string
+	Chunk_delay time.Duration
+	Requests    []ChatRequest
+
+	mutex sync.Mutex
+}
+
+func (s *ScriptedProvider) Stream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	call := len(s.Requests)
+	s.Requests = append(s.Requests, request)
+	if call >= len(s.Responses) {
+		return nil, fmt.Errorf("scripted provider has no response for call %d", call+1)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &scripted_stream{ctx: ctx, chunks: s.Responses[call], delay: s.Chunk_delay}, nil
+}
+
+type scripted_stream struct {
+	ctx    context.Context
+	chunks []string
+	delay  time.Duration
+	next   int
+	closed bool
+}
+
+func (s *scripted_stream) Recv() (string, error) {
+	if s.closed {
+		return "", errors.New("scripted stream is closed")
+	}
+	if s.delay > 0 {
+		timer := time.NewTimer(s.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+		}
+	}
+	if err := s.ctx.Err(); err != nil {
+		return "", err
+	}
+	if s.next >= len(s.chunks) {
+		return "", io.EOF
+	}
+
+	chunk := s.chunks[s.next]
+	s.next++
+	return chunk, nil
+}
+
+func (s *scripted_stream) Close() error {
+	s.closed = true
+	return nil
+}
+
+// Chunk_response splits text into chunks of size runes, which is handy for
+// simulating token-by-token streaming with a ScriptedProvider.
+func Chunk_response(text string, size int) []string {
+	if size <= 0 {
+		size = 1
+	}
+
+	runes := []rune(text)
+	var chunks []string
+	for start := 0; start < len(runes); start += size {
+		end := start + size
+		if end > len(runes) {
+			end = len(runes)
+		}
+		chunks = append(chunks, string(runes[start:end]))
+	}
+
+	return chunks
+}
@@ -0,0 +1,181 @@
+package prompt
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/farant/gpt-statemachine/besteffortjson"
+)
+
+type shape_kind int
+
+const (
+	shape_any shape_kind = iota
+	shape_object
+	shape_map
+	shape_array
+	shape_string
+	shape_integer
+	shape_number
+	shape_boolean
+)
+
+// type_shape is what the schemas know about a Go type: the kind of JSON
+// value it is encoded as, and its fields or elements. Struct_to_prompt_schema
+// and Type_to_json_schema both render it, so the example shown to the model
+// and the published contract can't disagree.
+type type_shape struct {
+	kind shape_kind
+	t    reflect.Type
+	// nullable is set for pointers, which encode nil as null.
+	nullable bool
+	unsigned bool
+	// format is the format the type always has, like date-time for
+	// time.Time, and base64 for []byte.
+	format string
+	fields []shape_field
+	// elem is the shape of the elements of an array, or of the values of a
+	// map, and key the shape of the keys of a map.
+	elem *type_shape
+	key  *type_shape
+	// recursive is set on a struct that contains itself. Where it does,
+	// the shape is a cycle pointing back to it instead of a copy.
+	recursive bool
+	cycle     *type_shape
+}
+
+type shape_field struct {
+	name     string
+	optional bool
+	quoted   bool
+	hints    field_hints
+	shape    *type_shape
+}
+
+var (
+	time_type           = reflect.TypeOf(time.Time{})
+	json_marshaler_type = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	text_marshaler_type = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// describe_type walks t the way encoding/json would encode it, naming fields
+// without a json tag name with naming. A nil t, the type of a nil interface,
+// can be anything.
+func describe_type(t reflect.Type, naming besteffortjson.Key_naming) *type_shape {
+	walker := shape_walker{naming: naming, visiting: map[reflect.Type]*type_shape{}}
+	return walker.describe(t)
+}
+
+type shape_walker struct {
+	naming besteffortjson.Key_naming
+	// visiting holds the structs being described, to catch recursion.
+	visiting map[reflect.Type]*type_shape
+}
+
+func (w shape_walker) describe(t reflect.Type) *type_shape {
+	shape := &type_shape{}
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+		shape.nullable = true
+	}
+	shape.t = t
+	shape.kind, shape.format = kind_of(t)
+
+	switch shape.kind {
+	case shape_object:
+		if outer, ok := w.visiting[t]; ok {
+			outer.recursive = true
+			shape.cycle = outer
+			return shape
+		}
+		w.visiting[t] = shape
+		defer delete(w.visiting, t)
+
+		for _, field := range besteffortjson.Fields(t, w.naming) {
+			shape.fields = append(shape.fields, shape_field{
+				name:     field.Name,
+				optional: field.Omitempty,
+				quoted:   field.Quoted,
+				hints:    hints_of(field.Struct_field.Tag),
+				shape:    w.describe(field.Struct_field.Type),
+			})
+		}
+	case shape_map:
+		shape.key = w.describe(t.Key())
+		shape.elem = w.describe(t.Elem())
+	case shape_array:
+		shape.elem = w.describe(t.Elem())
+	case shape_integer:
+		switch t.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			shape.unsigned = true
+		}
+	}
+	return shape
+}
+
+// kind_of is the kind of JSON value encoding/json encodes a t as. Types with
+// their own MarshalJSON can be anything, and those with MarshalText are
+// strings.
+func kind_of(t reflect.Type) (shape_kind, string) {
+	switch {
+	case t == nil:
+		return shape_any, ""
+	case t == time_type:
+		return shape_string, "date-time"
+	case implements(t, json_marshaler_type):
+		return shape_any, ""
+	case implements(t, text_marshaler_type):
+		return shape_string, ""
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return shape_object, ""
+	case reflect.Map:
+		return shape_map, ""
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 && !implements(t.Elem(), json_marshaler_type) && !implements(t.Elem(), text_marshaler_type) {
+			return shape_string, "base64"
+		}
+		return shape_array, ""
+	case reflect.Array:
+		return shape_array, ""
+	case reflect.String:
+		return shape_string, ""
+	case reflect.Bool:
+		return shape_boolean, ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return shape_integer, ""
+	case reflect.Float32, reflect.Float64:
+		return shape_number, ""
+	}
+	return shape_any, ""
+}
+
+func implements(t reflect.Type, iface reflect.Type) bool {
+	return t.Implements(iface) || (t.Kind() != reflect.Pointer && reflect.PointerTo(t).Implements(iface))
+}
+
+func (s *type_shape) is_number() bool {
+	return s.kind == shape_integer || s.kind == shape_number
+}
+
+// is_container is set for shapes written over several lines.
+func (s *type_shape) is_container() bool {
+	return s.kind == shape_object || s.kind == shape_array || s.kind == shape_map
+}
+
+// cycle_target is the recursive struct that s, or the elements of s, point
+// back to.
+func (s *type_shape) cycle_target() *type_shape {
+	for ; s != nil; s = s.elem {
+		if s.cycle != nil {
+			return s.cycle
+		}
+	}
+	return nil
+}
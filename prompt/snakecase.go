@@ -1,31 +1,8 @@
 package prompt
 
-import (
-	"bytes"
-	"log"
-	"regexp"
-	"strings"
-)
+import "github.com/farant/gpt-statemachine/besteffortjson"
 
+// To_snake_case is besteffortjson.Snake_case, the default key naming.
 func To_snake_case(str string) string {
-	// Convert camelcase to snake case
-	runes := []rune(str)
-	length := len(runes)
-	var buffer bytes.Buffer
-
-	for i := 0; i < length; i++ {
-		if runes[i] >= 'A' && runes[i] <= 'Z' && i != 0 {
-			buffer.WriteString("_")
-		}
-		buffer.WriteString(string(runes[i]))
-	}
-
-	// Convert spaces to underscores
-	str = strings.Replace(buffer.String(), " ", "_", -1)
-	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
-	if err != nil {
-		log.Fatal(err)
-	}
-	processed_string := reg.ReplaceAllString(str, "_")
-	return strings.ToLower(processed_string)
+	return besteffortjson.Snake_case(str)
 }
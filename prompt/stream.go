@@ -0,0 +1,51 @@
+package prompt
+
+import (
+	"context"
+	"runtime/debug"
+	"strings"
+)
+
+// stream_buffer is how many deltas the provider can get ahead of a slow
+// progress callback before it has to wait.
+const stream_buffer = 64
+
+// progress_handler is called with each delta and the accumulated response.
+type progress_handler func(delta string, total_progress string) error
+
+// start_progress starts the consumer side of the streaming pipeline. The
+// consumer always drains deltas until the producer closes the channel, so the
+// producer can never block on it, even after the handler has failed. The
+// returned channel yields the first handler failure (or nil) once the consumer
+// is finished. The handler isn't called any more once ctx is done.
+func start_progress(ctx context.Context, deltas <-chan string, handler progress_handler) <-chan error {
+	done := make(chan error, 1)
+
+	go func() {
+		var failure error
+		var total_progress strings.Builder
+
+		for delta := range deltas {
+			if handler == nil || failure != nil || ctx.Err() != nil {
+				continue
+			}
+
+			total_progress.WriteString(delta)
+			failure = call_handler(handler, delta, total_progress.String())
+		}
+
+		done <- failure
+	}()
+
+	return done
+}
+
+func call_handler(handler progress_handler, delta string, total_progress string) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = &CallbackError{Panic: recovered, Stack: debug.Stack()}
+		}
+	}()
+
+	return handler(delta, total_progress)
+}
@@ -0,0 +1,164 @@
+package prompt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// TemplateSyntax decides how the arguments are filled into the Prompt and
+// System texts.
+type TemplateSyntax int
+
+const (
+	// Syntax_placeholders replaces {{Name}} with the top level argument
+	// field Name, formatted with %v.
+	Syntax_placeholders TemplateSyntax = iota
+	// Syntax_text_template renders the texts with text/template, with the
+	// arguments as dot, so {{.Paper.Title}}, {{if}}, {{range}}, the
+	// Template_funcs helpers and {{template "name" .}} for Partials all
+	// work.
+	Syntax_text_template
+)
+
+// Template_funcs are the helpers available to Syntax_text_template prompts:
+//
+//	{{join ", " .Tags}}    the items of a slice separated by ", "
+//	{{bullets .Problems}}  the items of a slice as a "- " bullet list
+//	{{json .Paper}}        a value as JSON
+//	{{quote .Subject}}     a value as a double quoted string
+//	{{untrusted "notes" .Notes}}  a value wrapped in <notes> tags, see
+//	                       Wrap_untrusted
+var Template_funcs = template.FuncMap{
+	"join":      template_join,
+	"bullets":   template_bullets,
+	"json":      template_json,
+	"quote":     template_quote,
+	"untrusted": Wrap_untrusted,
+}
+
+func (p Prompt[Output, Input]) render(text string, arguments Input) (string, error) {
+	if p.Syntax == Syntax_text_template {
+		return p.render_template(text, arguments)
+	}
+	return p.render_placeholders(text, arguments)
+}
+
+var placeholder_pattern = regexp.MustCompile(`{{(\w+)}}`)
+
+// render_placeholders replaces every placeholder in a single pass, so
+// arguments that contain placeholders themselves are left as they are.
+func (p Prompt[Output, Input]) render_placeholders(text string, arguments Input) (string, error) {
+	if !placeholder_pattern.MatchString(text) {
+		return text, nil
+	}
+
+	arguments_map, err := p.StructToMap(arguments)
+	if err != nil {
+		return "", &TemplateError{Err: err}
+	}
+
+	trust := p.argument_trust()
+	var missing error
+	text = placeholder_pattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		keyword := placeholder[2 : len(placeholder)-2]
+		val, ok := arguments_map[keyword]
+		if !ok {
+			if missing == nil {
+				missing = &TemplateError{Placeholder: keyword, Err: errors.New("argument not found in options")}
+			}
+			return placeholder
+		}
+		if tag, untrusted := trust.tag(keyword); untrusted {
+			return Wrap_untrusted(tag, val)
+		}
+		return fmt.Sprintf("%v", val)
+	})
+	if missing != nil {
+		return "", missing
+	}
+
+	return text, nil
+}
+
+func (p Prompt[Output, Input]) render_template(text string, arguments Input) (string, error) {
+	var tmpl *template.Template
+	if p.compiled != nil {
+		tmpl = p.compiled.templates[text]
+	}
+	if tmpl == nil {
+		var err error
+		if tmpl, err = p.parse_template(text); err != nil {
+			return "", err
+		}
+	}
+
+	var output strings.Builder
+	if err := tmpl.Execute(&output, arguments); err != nil {
+		return "", &TemplateError{Err: err}
+	}
+	return output.String(), nil
+}
+
+// parse_template parses text along with the Partials it can include.
+func (p Prompt[Output, Input]) parse_template(text string) (*template.Template, error) {
+	tmpl := template.New("prompt").Funcs(Template_funcs).Option("missingkey=error")
+	for name, partial := range p.Partials {
+		if _, err := tmpl.New(name).Parse(partial); err != nil {
+			return nil, &TemplateError{Placeholder: name, Err: err}
+		}
+	}
+	if _, err := tmpl.Parse(text); err != nil {
+		return nil, &TemplateError{Err: err}
+	}
+	if trust := p.argument_trust(); len(trust.tags) > 0 || trust.all {
+		if err := wrap_untrusted_actions(tmpl, trust); err != nil {
+			return nil, &TemplateError{Err: err}
+		}
+	}
+	return tmpl, nil
+}
+
+// template_items lists the items of a slice or array, or the value itself if
+// it is neither.
+func template_items(value interface{}) []string {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		if value == nil {
+			return nil
+		}
+		return []string{fmt.Sprint(value)}
+	}
+
+	items := make([]string, v.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return items
+}
+
+func template_join(separator string, items interface{}) string {
+	return strings.Join(template_items(items), separator)
+}
+
+func template_bullets(items interface{}) string {
+	lines := template_items(items)
+	for i, line := range lines {
+		lines[i] = "- " + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+func template_json(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+func template_quote(value interface{}) string {
+	return strconv.Quote(fmt.Sprint(value))
+}
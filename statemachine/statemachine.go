@@ -0,0 +1,131 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/farant/gpt-statemachine/prompt"
+)
+
+// Done is returned from a transition to stop the machine.
+const Done = ""
+
+const default_max_steps = 100
+
+// State is a single node of a Machine. It runs against the shared Data and
+// returns the name of the next state (or Done) along with whatever result it
+// wants recorded in the trace.
+type State[Data any] interface {
+	Run(ctx context.Context, provider prompt.Provider, data *Data) (next string, result any, err error)
+}
+
+// Step is one entry of a run trace. For prompt states Result holds the
+// prompt.PromptResult of the prompt that ran, for function states it is nil.
+type Step struct {
+	State  string
+	Result any
+}
+
+type Machine[Data any] struct {
+	Start     string
+	States    map[string]State[Data]
+	Max_steps int
+}
+
+func (m Machine[Data]) Run(provider prompt.Provider, data *Data) ([]Step, error) {
+	return m.RunContext(context.Background(), provider, data)
+}
+
+// RunContext runs the machine until a transition returns Done. The context is
+// passed to every state and checked before each one starts.
+func (m Machine[Data]) RunContext(ctx context.Context, provider prompt.Provider, data *Data) ([]Step, error) {
+	max_steps := m.Max_steps
+	if max_steps <= 0 {
+		max_steps = default_max_steps
+	}
+
+	var trace []Step
+	current := m.Start
+	for current != Done {
+		if err := ctx.Err(); err != nil {
+			return trace, err
+		}
+		if len(trace) >= max_steps {
+			return trace, fmt.Errorf("statemachine: exceeded %d steps, last state %q", max_steps, current)
+		}
+
+		state, ok := m.States[current]
+		if !ok {
+			return trace, fmt.Errorf("statemachine: unknown state %q", current)
+		}
+
+		next, result, err := state.Run(ctx, provider, data)
+		trace = append(trace, Step{State: current, Result: result})
+		if err != nil {
+			return trace, fmt.Errorf("statemachine: state %q: %w", current, err)
+		}
+
+		current = next
+	}
+
+	return trace, nil
+}
+
+// Result_of returns the typed prompt result recorded for a step, if the step
+// ran a prompt with the given Output type.
+func Result_of[Output any](step Step) (prompt.PromptResult[Output], bool) {
+	result, ok := step.Result.(prompt.PromptResult[Output])
+	return result, ok
+}
+
+type prompt_state[Output any, Input any, Data any] struct {
+	prompt     prompt.Prompt[Output, Input]
+	options    func(data *Data) prompt.RunOptions[Output, Input]
+	transition func(data *Data, result prompt.PromptResult[Output]) string
+}
+
+// Prompt_state wraps a prompt. options builds the RunOptions (arguments and
+// callbacks) from the current Data, and transition picks the next state from
+// the typed result. A nil transition ends the machine after this state.
+func Prompt_state[Output any, Input any, Data any](
+	p prompt.Prompt[Output, Input],
+	options func(data *Data) prompt.RunOptions[Output, Input],
+	transition func(data *Data, result prompt.PromptResult[Output]) string,
+) State[Data] {
+	return prompt_state[Output, Input, Data]{
+		prompt:     p,
+		options:    options,
+		transition: transition,
+	}
+}
+
+func (s prompt_state[Output, Input, Data]) Run(ctx context.Context, provider prompt.Provider, data *Data) (string, any, error) {
+	var options prompt.RunOptions[Output, Input]
+	if s.options != nil {
+		options = s.options(data)
+	}
+
+	result, err := s.prompt.RunContext(ctx, provider, options)
+	if err != nil {
+		return Done, result, err
+	}
+
+	if s.transition == nil {
+		return Done, result, nil
+	}
+	return s.transition(data, result), result, nil
+}
+
+type func_state[Data any] struct {
+	fn func(data *Data) (string, error)
+}
+
+// Func_state wraps a plain Go function that returns the next state.
+func Func_state[Data any](fn func(data *Data) (string, error)) State[Data] {
+	return func_state[Data]{fn: fn}
+}
+
+func (s func_state[Data]) Run(ctx context.Context, provider prompt.Provider, data *Data) (string, any, error) {
+	next, err := s.fn(data)
+	return next, nil, err
+}
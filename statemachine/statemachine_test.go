@@ -0,0 +1,213 @@
+package statemachine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/farant/gpt-statemachine/prompt"
+)
+
+func TestMachine_Run(t *testing.T) {
+	type Data struct {
+		Count   int
+		Visited []string
+	}
+
+	visit := func(name string, next func(data *Data) string) State[Data] {
+		return Func_state(func(data *Data) (string, error) {
+			data.Visited = append(data.Visited, name)
+			return next(data), nil
+		})
+	}
+
+	testCases := []struct {
+		name          string
+		machine       Machine[Data]
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name: "Linear chain",
+			machine: Machine[Data]{
+				Start: "one",
+				States: map[string]State[Data]{
+					"one":   visit("one", func(*Data) string { return "two" }),
+					"two":   visit("two", func(*Data) string { return "three" }),
+					"three": visit("three", func(*Data) string { return Done }),
+				},
+			},
+			expected: []string{"one", "two", "three"},
+		},
+		{
+			name: "Loop until condition",
+			machine: Machine[Data]{
+				Start: "count",
+				States: map[string]State[Data]{
+					"count": visit("count", func(data *Data) string {
+						data.Count++
+						if data.Count < 3 {
+							return "count"
+						}
+						return Done
+					}),
+				},
+			},
+			expected: []string{"count", "count", "count"},
+		},
+		{
+			name: "Unknown state",
+			machine: Machine[Data]{
+				Start: "one",
+				States: map[string]State[Data]{
+					"one": visit("one", func(*Data) string { return "missing" }),
+				},
+			},
+			expected:      []string{"one"},
+			expectedError: true,
+		},
+		{
+			name: "Max steps",
+			machine: Machine[Data]{
+				Start:     "forever",
+				Max_steps: 2,
+				States: map[string]State[Data]{
+					"forever": visit("forever", func(*Data) string { return "forever" }),
+				},
+			},
+			expected:      []string{"forever", "forever"},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := Data{}
+			trace, err := tc.machine.Run(nil, &data)
+			if (err != nil) != tc.expectedError {
+				t.Fatalf("Expected error %v, got %v", tc.expectedError, err)
+			}
+
+			var states []string
+			for _, step := range trace {
+				states = append(states, step.State)
+			}
+			if !reflect.DeepEqual(states, tc.expected) {
+				t.Errorf("Expected trace %v, got %v", tc.expected, states)
+			}
+			if !reflect.DeepEqual(data.Visited, tc.expected) {
+				t.Errorf("Expected visited %v, got %v", tc.expected, data.Visited)
+			}
+		})
+	}
+}
+
+func TestMachine_Run_function_error(t *testing.T) {
+	failure := errors.New("boom")
+	machine := Machine[struct{}]{
+		Start: "fail",
+		States: map[string]State[struct{}]{
+			"fail": Func_state(func(*struct{}) (string, error) { return "", failure }),
+		},
+	}
+
+	trace, err := machine.Run(nil, &struct{}{})
+	if !errors.Is(err, failure) {
+		t.Errorf("Expected wrapped error, got %v", err)
+	}
+	if len(trace) != 1 || trace[0].State != "fail" {
+		t.Errorf("Expected failing state in trace, got %v", trace)
+	}
+}
+
+func TestMachine_Run_prompt_states(t *testing.T) {
+	type Idea struct {
+		Title string `json:"title"`
+	}
+	type Arguments struct {
+		Topic string
+	}
+	type Data struct {
+		Ideas []Idea
+	}
+
+	provider := &prompt.ScriptedProvider{
+		Responses: [][]string{
+			prompt.Chunk_response(`{"results": [{"title": "first"}]}`, 4),
+			prompt.Chunk_response(`{"results": [{"title": "second"}, {"title": "third"}]}`, 4),
+		},
+	}
+
+	ideas := prompt.Prompt[Idea, Arguments]{
+		Prompt:           "Ideas about {{Topic}}",
+		Json_output:      Idea{},
+		Array_of_results: true,
+	}
+
+	options := func(data *Data) prompt.RunOptions[Idea, Arguments] {
+		return prompt.RunOptions[Idea, Arguments]{
+			Arguments: Arguments{Topic: "go"},
+		}
+	}
+
+	machine := Machine[Data]{
+		Start: "draft",
+		States: map[string]State[Data]{
+			"draft": Prompt_state(ideas, options, func(data *Data, result prompt.PromptResult[Idea]) string {
+				data.Ideas = result.Parsed_results_array
+				return "refine"
+			}),
+			"refine": Prompt_state(ideas, options, func(data *Data, result prompt.PromptResult[Idea]) string {
+				data.Ideas = append(data.Ideas, result.Parsed_results_array...)
+				return Done
+			}),
+		},
+	}
+
+	data := Data{}
+	trace, err := machine.Run(provider, &data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []Idea{{Title: "first"}, {Title: "second"}, {Title: "third"}}
+	if !reflect.DeepEqual(data.Ideas, expected) {
+		t.Errorf("Expected %v, got %v", expected, data.Ideas)
+	}
+
+	if len(trace) != 2 {
+		t.Fatalf("Expected 2 steps, got %d", len(trace))
+	}
+	result, ok := Result_of[Idea](trace[1])
+	if !ok || trace[1].State != "refine" || len(result.Parsed_results_array) != 2 {
+		t.Errorf("Expected refine step with typed result, got %+v", trace[1])
+	}
+}
+
+func TestMachine_RunContext_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	machine := Machine[int]{
+		Start: "count",
+		States: map[string]State[int]{
+			"count": Func_state(func(count *int) (string, error) {
+				*count++
+				if *count == 2 {
+					cancel()
+				}
+				return "count", nil
+			}),
+		},
+	}
+
+	count := 0
+	trace, err := machine.RunContext(ctx, nil, &count)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if len(trace) != 2 || count != 2 {
+		t.Errorf("Expected the machine to stop after 2 steps, got %d", len(trace))
+	}
+}